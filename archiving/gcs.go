@@ -0,0 +1,71 @@
+//go:build gcs
+// +build gcs
+
+package archiving
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// supportsGCS tells whether archives can be uploaded to Google Cloud Storage, whose client is only part of the binaries
+// built with the gcs tag.
+const supportsGCS = true
+
+// gcsClient is the Cloud Storage client shared by the runs uploading to GCS.
+var gcsClient *storage.Client
+
+// initGCSClient creates the Cloud Storage client with the default credentials of the environment when archives are
+// uploaded to GCS, the client of a previous run being closed. Only its creation is bounded by the timeout, as the client
+// is reused by the uploads of the next runs.
+func initGCSClient() {
+	if gcsClient != nil {
+		gcsClient.Close()
+		gcsClient = nil
+	}
+	if destinationType != "gcs" {
+		return
+	}
+
+	duration, _ := time.ParseDuration(timeout)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), duration)
+	defer cancelFn()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		panic(fmt.Errorf("failed to create the GCS client, %v", err))
+	}
+	gcsClient = client
+}
+
+// uploadGCSArchive uploads the generated archive to a Google Cloud Storage bucket. The checksum is only used by S3
+// options, which are not supported by this destination. As the upload lasts as long as the transfer of the whole
+// archive, it's only bounded by the deadline of the run.
+func uploadGCSArchive(ctx context.Context, archive *os.File, destination string, key string, _ string) error {
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// GCS object names have no leading slash, unlike the S3 keys of this function.
+	writer := gcsClient.Bucket(destination).Object(strings.TrimPrefix(key, "/")).NewWriter(ctx)
+	writer.Metadata = aws.StringValueMap(archiveMetadata)
+	if _, err := io.Copy(writer, archive); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload the archive to \"gs://%s\", %v", destination, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload the archive to \"gs://%s\", %v", destination, err)
+	}
+
+	logInfo(fmt.Sprintf("Logs successfully uploaded to \"gs://%s\".", destination))
+
+	return nil
+}
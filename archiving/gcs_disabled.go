@@ -0,0 +1,22 @@
+//go:build !gcs
+// +build !gcs
+
+package archiving
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// supportsGCS tells whether archives can be uploaded to Google Cloud Storage, whose client is only part of the binaries
+// built with the gcs tag.
+const supportsGCS = false
+
+// initGCSClient does nothing, as the GCS destination is refused at startup without the gcs tag.
+func initGCSClient() {}
+
+// uploadGCSArchive always fails, as the GCS destination is refused at startup without the gcs tag.
+func uploadGCSArchive(context.Context, *os.File, string, string, string) error {
+	return errors.New("uploading to GCS requires a binary built with the gcs tag")
+}
@@ -0,0 +1,83 @@
+//go:build gcs
+// +build gcs
+
+package archiving
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGCSDestination(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	object := useFakeGCS(t)
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"destination": "gcs"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if object.name != "prod/2024-06-01.tar.gz" || summary.Key != "/prod/2024-06-01.tar.gz" {
+		t.Errorf("unexpected object name: %s", object.name)
+	}
+	if entries := readTarGz(t, object.content); entries["web-1.log"].content != "first\n" {
+		t.Errorf("unexpected archive content: %v", entries)
+	}
+	if len(fake.calls("PutObject")) > 0 || len(fake.calls("HeadBucket")) > 0 {
+		t.Error("S3 must not be called with the gcs destination")
+	}
+
+	client := gcsClient
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"destination": "gcs"})); err != nil || gcsClient != client {
+		t.Errorf("the GCS client must be reused by the next runs (error: %v)", err)
+	}
+}
+
+// gcsObject is the object uploaded to the fake Cloud Storage service.
+type gcsObject struct {
+	name    string
+	content []byte
+}
+
+// useFakeGCS points the Cloud Storage client to a fake service, for the duration of the test.
+func useFakeGCS(t *testing.T) *gcsObject {
+	t.Helper()
+	object := &gcsObject{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/archives/o") {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		// The metadata of the object is followed by its content.
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for part, err := reader.NextPart(); err == nil; part, err = reader.NextPart() {
+			body, _ := io.ReadAll(part)
+			var metadata struct{ Name string }
+			if json.Unmarshal(body, &metadata) == nil && len(metadata.Name) > 0 {
+				object.name = metadata.Name
+			} else {
+				object.content = body
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"bucket": "archives", "name": object.name, "size": strconv.Itoa(len(object.content))})
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	// The emulator is read when the client is created, which is shared by the next runs.
+	resetServices()
+
+	return object
+}
@@ -0,0 +1,4763 @@
+// Package archiving archives the CloudWatch logs of a day into S3 (or GCS) buckets. It backs the Lambda function and
+// the CLI, and can also be called by other Go services through ArchiveGroup and ArchiveStream.
+package archiving
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/itchyny/gojq"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/pgzip"
+)
+
+const workspace = string(os.PathSeparator) + "tmp" + string(os.PathSeparator) + "workspace"
+
+// workspaceLock is the lock file preventing concurrent processes from using the same workspace. It holds the PID of
+// its owner and the deadline of its run as a Unix time (0 without deadline).
+const workspaceLock = workspace + ".lock"
+const timeout = "10s"
+
+// streamPAXRecord is the PAX record of tar headers holding the original name of a log stream.
+const streamPAXRecord = "LOGS_ARCHIVING.stream"
+
+// minWriteBufferBytes is the smallest buffer accepted to write log files, smaller ones causing too many writes.
+const minWriteBufferBytes = 4096
+
+// readmeName is the name of the README describing the archive, when it must be included.
+const readmeName = "README.txt"
+
+// maxDescribeLimit is the largest number of log streams CloudWatch returns per page.
+const maxDescribeLimit = 50
+
+// maxInsightsLimit is the largest number of results CloudWatch returns for a Logs Insights query.
+const maxInsightsLimit = 10000
+
+// insightsPollInterval is the delay between two polls of the results of a Logs Insights query.
+const insightsPollInterval = time.Second
+
+// mergeSuffix is the suffix of the files holding the events of a stream before they are merged.
+const mergeSuffix = ".events"
+
+// binaryPrefix marks the messages which have been base64-encoded because they were not valid text.
+const binaryPrefix = "[base64] "
+
+// formatExtensions maps each archive format to the extension of the files it compresses.
+var formatExtensions = map[string]string{
+	"gzip":   ".gz",
+	"bzip2":  ".bz2",
+	"snappy": ".sz",
+	"none":   "",
+}
+
+// dateFormatPresets are the named layouts accepted by the date-format flag.
+var dateFormatPresets = map[string]string{
+	"iso":     "2006-01-02",
+	"compact": "20060102",
+	"path":    "2006/01/02",
+}
+
+// nameSuffixPattern restricts the name-suffix flag to characters which are safe in object keys and file names.
+var nameSuffixPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// directoryBucketPattern matches the names of S3 directory buckets (Express One Zone), which end with the ID of their
+// zone (e.g. "logs--usw2-az1--x-s3").
+var directoryBucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*[a-z0-9]--[a-z0-9]+-[a-z0-9-]+--x-s3$`)
+
+// errTooManyEvents is returned when a time window holds more events than the split-threshold flag.
+var errTooManyEvents = errors.New("too many events in the time window")
+
+// errAPITimeout is returned when a CloudWatch API call exceeds the api-timeout flag.
+var errAPITimeout = errors.New("the CloudWatch API call has timed out")
+
+// errArchiveTooSmall is returned when the archive is smaller than the min-archive-bytes flag.
+var errArchiveTooSmall = errors.New("the archive is suspiciously small")
+
+const webhookAttempts = 3
+
+var (
+	configFile string
+
+	bucket      string
+	buckets     []string
+	environment string
+	template    string
+	logGroup    string
+
+	logGroupPrefix string
+	groupTree      bool
+	groupDirectory string
+
+	streamNameList   string
+	streamNames      []string
+	target           string
+	dateFormat       string
+	nameSuffix       string
+	today            bool
+	startHour        int
+	endHour          int
+	minAgeHours      int
+	minRetentionDays int
+	force            bool
+	quiet            bool
+	diagnostics      bool
+	listMode         bool
+	listStreamsMode  bool
+	dryRun           bool
+	selfCheck        bool
+	uploadEmpty      bool
+	keepWorkspace    bool
+	cleanWorkspace   bool
+	keepEmpty        bool
+	partialIsSuccess bool
+	failOnPartial    bool
+	skipInactive     bool
+	requireStreams   bool
+
+	streamParallelism int
+	describeLimit     int
+	progressInterval  time.Duration
+	apiTimeout        time.Duration
+	dialTimeout       time.Duration
+	tlsTimeout        time.Duration
+	httpTimeout       time.Duration
+	maxRetries        int
+	retryBaseDelay    time.Duration
+	retryMaxDelay     time.Duration
+	retriableCodeList string
+	retriableCodes    []string
+	safetyMargin      time.Duration
+	settleWait        time.Duration
+	watermarkMode     bool
+	splitThreshold    int64
+	writeBufferBytes  int
+	streamBufferBytes int
+	maxMemoryBytes    int64
+	fromTail          bool
+	encodeBinary      bool
+	mergeMode         bool
+	mergePrefix       bool
+
+	includeTimestamps    bool
+	includeIngestionTime bool
+	fieldDelimiter       string
+	terminatorName       string
+	projectionQuery      string
+	projection           *gojq.Code
+	dropNonJSON          bool
+	dropPatterns         string
+	dropRegexps          []*regexp.Regexp
+	redactList           string
+	redactRules          []redactRule
+	lineTerminator       string
+
+	archiveFormat string
+	noCompression bool
+	parallelGzip  bool
+	gzipComment   string
+	noTar         bool
+	perFileGzip   bool
+
+	compressionConcurrency int
+	compressionSlots       chan struct{}
+	chunked                bool
+	includeReadme          bool
+	chunkCount             int
+	chunkWorkers           int
+	reproducible           bool
+	tarPrefix              string
+	tarUID                 int
+	tarGID                 int
+	tarUname               string
+	tarGname               string
+
+	partitionStyle string
+
+	insightsQuery  string
+	insightsFormat string
+	insightsLimit  int
+
+	maxTotalBytes   int64
+	minArchiveBytes int64
+	minArchiveCheck string
+
+	uploadPartSize    int64
+	uploadConcurrency int
+
+	presignedURL    string
+	webhookURL      string
+	webhookDelay    time.Duration
+	destinationType string
+
+	metadataList   string
+	metadataValues map[string]string
+
+	objectACL           string
+	storageClass        string
+	expectedBucketOwner string
+	verifyUpload        bool
+	verifyTimeout       time.Duration
+	overwrite           bool
+	precheckBucket      bool
+	streamUpload        bool
+	writeChecksumFile   bool
+
+	startDate     time.Time
+	endDate       time.Time
+	scheduledTime time.Time
+
+	stats           *progress
+	streamStats     map[string]*progress
+	truncated       bool
+	streamFiles     map[string]string
+	archiveMetadata map[string]*string
+
+	// newTicker returns the ticks of progress logs and the function stopping them, replaced in tests.
+	newTicker = func(interval time.Duration) (<-chan time.Time, func()) {
+		ticker := time.NewTicker(interval)
+		return ticker.C, ticker.Stop
+	}
+
+	// after returns the channel delivering the end of a wait, replaced in tests.
+	after = time.After
+
+	watermarkRun      time.Time
+	watermarks        map[string]int64
+	pendingWatermarks map[string]int64
+	watermarkMutex    sync.Mutex
+
+	profile string
+	region  string
+
+	// runMutex serializes the runs of the process, which share the state of the package.
+	runMutex sync.Mutex
+
+	// servicesMutex guards the creation of the service clients and the options they have been created with, nil until
+	// they are. A sync.Once does not fit, as the clients are created again whenever a run comes with other options, and
+	// discarded by resetServices.
+	servicesMutex   sync.Mutex
+	servicesOptions *serviceOptions
+	awsHTTPClient   *http.Client
+	awsSession      *session.Session
+	cwService       *cloudwatchlogs.CloudWatchLogs
+	s3Service       *s3.S3
+	logsService     logsAPI
+
+	// awsTransport is the transport of the HTTP client of the AWS services, the default one being used if nil. It's
+	// replaced in tests.
+	awsTransport http.RoundTripper
+
+	otelEndpoint string
+)
+
+// logsAPI is the subset of CloudWatch Logs operations used to download log streams, implemented on top of the AWS SDK
+// selected at build time. Inputs and outputs are expressed with the types of the first version of the SDK.
+type logsAPI interface {
+	DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+	GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error)
+}
+
+// objectsAPI is the subset of S3 operations used to upload archives into a given region (and to remove the probe object
+// of the self-check), implemented on top of the AWS SDK selected at build time.
+type objectsAPI interface {
+	PutObject(ctx context.Context, input *s3.PutObjectInput) error
+	DeleteObject(ctx context.Context, input *s3.DeleteObjectInput) error
+}
+
+// flagSet holds the options of the archiving process, distinct from the command line flags of the services importing the
+// package.
+var flagSet = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+// flagEnvironment maps each flag to the environment variable providing its default value, so that configuration files
+// never override environment variables.
+var flagEnvironment = map[string]string{
+	"bucket":                  "BUCKET_NAME",
+	"environment":             "ENVIRONMENT_NAME",
+	"log-group-template":      "LOG_GROUP_TEMPLATE",
+	"log-group-prefix":        "LOG_GROUP_PREFIX",
+	"group-tree":              "GROUP_TREE",
+	"streams":                 "STREAM_NAMES",
+	"profile":                 "AWS_PROFILE",
+	"region":                  "AWS_REGION",
+	"target":                  "TARGET_DATE",
+	"date-format":             "DATE_FORMAT",
+	"name-suffix":             "NAME_SUFFIX",
+	"today":                   "ARCHIVE_TODAY",
+	"start-hour":              "START_HOUR",
+	"end-hour":                "END_HOUR",
+	"min-age-hours":           "MIN_AGE_HOURS",
+	"min-retention-days":      "MIN_RETENTION_DAYS",
+	"force":                   "FORCE",
+	"quiet":                   "QUIET",
+	"diagnostics":             "DIAGNOSTICS",
+	"dry-run":                 "DRY_RUN",
+	"selfcheck":               "SELF_CHECK",
+	"list":                    "LIST_ARCHIVES",
+	"list-streams":            "LIST_STREAMS",
+	"skip-inactive":           "SKIP_INACTIVE",
+	"require-streams":         "REQUIRE_STREAMS",
+	"partial-is-success":      "PARTIAL_IS_SUCCESS",
+	"fail-on-partial":         "FAIL_ON_PARTIAL",
+	"keep-empty":              "KEEP_EMPTY",
+	"keep-workspace":          "KEEP_WORKSPACE",
+	"clean":                   "CLEAN_WORKSPACE",
+	"upload-empty":            "UPLOAD_EMPTY",
+	"describe-limit":          "DESCRIBE_LIMIT",
+	"stream-parallelism":      "STREAM_PARALLELISM",
+	"write-buffer-bytes":      "WRITE_BUFFER_BYTES",
+	"from-tail":               "FROM_TAIL",
+	"encode-binary":           "ENCODE_BINARY",
+	"merge":                   "MERGE_STREAMS",
+	"merge-prefix":            "MERGE_PREFIX",
+	"include-timestamps":      "INCLUDE_TIMESTAMPS",
+	"include-ingestion-time":  "INCLUDE_INGESTION_TIME",
+	"line-terminator":         "LINE_TERMINATOR",
+	"jq":                      "JQ_PROJECTION",
+	"jq-drop-invalid":         "JQ_DROP_INVALID",
+	"drop-pattern":            "DROP_PATTERNS",
+	"redact":                  "REDACT_RULES",
+	"field-delimiter":         "FIELD_DELIMITER",
+	"split-threshold":         "SPLIT_THRESHOLD",
+	"watermark":               "WATERMARK",
+	"settle-wait":             "SETTLE_WAIT",
+	"safety-margin":           "SAFETY_MARGIN",
+	"api-timeout":             "API_TIMEOUT",
+	"dial-timeout":            "DIAL_TIMEOUT",
+	"tls-handshake-timeout":   "TLS_HANDSHAKE_TIMEOUT",
+	"http-timeout":            "HTTP_TIMEOUT",
+	"max-retries":             "MAX_RETRIES",
+	"retry-base-delay":        "RETRY_BASE_DELAY",
+	"retry-max-delay":         "RETRY_MAX_DELAY",
+	"retriable-codes":         "RETRIABLE_CODES",
+	"progress-interval":       "PROGRESS_INTERVAL",
+	"no-compression":          "NO_COMPRESSION",
+	"format":                  "ARCHIVE_FORMAT",
+	"parallel-gzip":           "PARALLEL_GZIP",
+	"gzip-comment":            "GZIP_COMMENT",
+	"reproducible":            "REPRODUCIBLE",
+	"include-readme":          "INCLUDE_README",
+	"chunked":                 "CHUNKED",
+	"chunks":                  "CHUNKS",
+	"chunk-workers":           "CHUNK_WORKERS",
+	"per-file-gzip":           "PER_FILE_GZIP",
+	"compression-concurrency": "COMPRESSION_CONCURRENCY",
+	"partition-style":         "PARTITION_STYLE",
+	"tar-uid":                 "TAR_UID",
+	"tar-gid":                 "TAR_GID",
+	"tar-uname":               "TAR_UNAME",
+	"tar-gname":               "TAR_GNAME",
+	"tar-prefix":              "TAR_PREFIX",
+	"no-tar":                  "NO_TAR",
+	"max-total-bytes":         "MAX_TOTAL_BYTES",
+	"min-archive-bytes":       "MIN_ARCHIVE_BYTES",
+	"min-archive-check":       "MIN_ARCHIVE_CHECK",
+	"insights-query":          "INSIGHTS_QUERY",
+	"insights-format":         "INSIGHTS_FORMAT",
+	"insights-limit":          "INSIGHTS_LIMIT",
+	"destination":             "DESTINATION",
+	"webhook-url":             "WEBHOOK_URL",
+	"webhook-retry-delay":     "WEBHOOK_RETRY_DELAY",
+	"otel-endpoint":           "OTEL_ENDPOINT",
+	"presigned-url":           "PRESIGNED_URL",
+	"metadata":                "OBJECT_METADATA",
+	"acl":                     "OBJECT_ACL",
+	"storage-class":           "STORAGE_CLASS",
+	"expected-bucket-owner":   "EXPECTED_BUCKET_OWNER",
+	"upload-part-size":        "UPLOAD_PART_SIZE",
+	"upload-concurrency":      "UPLOAD_CONCURRENCY",
+	"max-memory-bytes":        "MAX_MEMORY_BYTES",
+	"stream-upload":           "STREAM_UPLOAD",
+	"write-checksum-file":     "WRITE_CHECKSUM_FILE",
+	"precheck-bucket":         "PRECHECK_BUCKET",
+	"overwrite":               "OVERWRITE",
+	"verify-upload":           "VERIFY_UPLOAD",
+	"verify-timeout":          "VERIFY_TIMEOUT",
+}
+
+func init() {
+	flagSet.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "The JSON file providing the options which are neither flags nor environment variables.")
+	flagSet.StringVar(&bucket, "bucket", os.Getenv("BUCKET_NAME"), "The S3 bucket names (comma-separated) where logs will be archived.")
+	flagSet.StringVar(&environment, "environment", os.Getenv("ENVIRONMENT_NAME"), "The environment name from where logs have been generated.")
+	flagSet.StringVar(&template, "log-group-template", getEnv("LOG_GROUP_TEMPLATE", "{env}"), "The name of the log group, where {env} is replaced by the environment name.")
+	flagSet.StringVar(&logGroupPrefix, "log-group-prefix", os.Getenv("LOG_GROUP_PREFIX"), "The prefix of the log groups to discover and archive, instead of an environment.")
+	flagSet.BoolVar(&groupTree, "group-tree", getEnvBool("GROUP_TREE", false), "Whether the discovered log groups must be archived into a single archive mirroring their hierarchy.")
+	flagSet.StringVar(&streamNameList, "streams", os.Getenv("STREAM_NAMES"), "The names (comma-separated) of the only log streams to archive.")
+	flagSet.StringVar(&profile, "profile", os.Getenv("AWS_PROFILE"), "The AWS profile whose credentials must be used, instead of the default credential chain.")
+	flagSet.StringVar(&region, "region", os.Getenv("AWS_REGION"), "The AWS region of the CloudWatch log groups.")
+	flagSet.StringVar(&target, "target", os.Getenv("TARGET_DATE"), "The day on which the logs must be archived.")
+	flagSet.StringVar(&dateFormat, "date-format", getEnv("DATE_FORMAT", "iso"), "The layout of the date in the archive name, either a Go layout or a preset (iso, compact, path).")
+	flagSet.StringVar(&nameSuffix, "name-suffix", os.Getenv("NAME_SUFFIX"), "The suffix appended to the archive name before its extension, so that variant archives of a day coexist.")
+	flagSet.BoolVar(&today, "today", getEnvBool("ARCHIVE_TODAY", false), "Whether the current day must be partially archived.")
+	flagSet.IntVar(&startHour, "start-hour", getEnvInt("START_HOUR", 0), "The hour (UTC) from which the events of the archived day are archived.")
+	flagSet.IntVar(&endHour, "end-hour", getEnvInt("END_HOUR", 24), "The hour (UTC) until which the events of the archived day are archived (excluded).")
+	flagSet.IntVar(&minAgeHours, "min-age-hours", getEnvInt("MIN_AGE_HOURS", 0), "The number of hours which must have elapsed since the end of the archived day.")
+	flagSet.IntVar(&minRetentionDays, "min-retention-days", getEnvInt("MIN_RETENTION_DAYS", 0), "The retention (in days) of the log group from which archiving is skipped as redundant (disabled if zero).")
+	flagSet.BoolVar(&force, "force", getEnvBool("FORCE", false), "Whether safety checks (such as the minimum age) must be bypassed.")
+	flagSet.BoolVar(&quiet, "quiet", getEnvBool("QUIET", false), "Whether informational logs must be suppressed, errors and the summary being still displayed.")
+	flagSet.BoolVar(&diagnostics, "diagnostics", getEnvBool("DIAGNOSTICS", false), "Whether the Lambda environment and Go runtime statistics must be included in the summary.")
+	flagSet.BoolVar(&dryRun, "dry-run", getEnvBool("DRY_RUN", false), "Whether the log streams must only be estimated, without downloading nor uploading anything.")
+	flagSet.BoolVar(&selfCheck, "selfcheck", getEnvBool("SELF_CHECK", false), "Whether the permissions required by the archiving process must only be checked, without archiving anything.")
+	flagSet.BoolVar(&listMode, "list", getEnvBool("LIST_ARCHIVES", false), "Whether existing archives must be listed instead of archiving logs.")
+	flagSet.BoolVar(&listStreamsMode, "list-streams", getEnvBool("LIST_STREAMS", false), "Whether the log streams which would be archived must be listed instead of archiving logs.")
+	flagSet.BoolVar(&skipInactive, "skip-inactive", getEnvBool("SKIP_INACTIVE", true), "Whether log streams without any event during the archived day must be skipped before downloading them.")
+	flagSet.BoolVar(&requireStreams, "require-streams", getEnvBool("REQUIRE_STREAMS", false), "Whether the process must fail when the log group has no log stream at all.")
+	flagSet.BoolVar(&partialIsSuccess, "partial-is-success", getEnvBool("PARTIAL_IS_SUCCESS", false), "Whether the handler must succeed when the run partially failed, failing only when nothing has been uploaded.")
+	flagSet.BoolVar(&failOnPartial, "fail-on-partial", getEnvBool("FAIL_ON_PARTIAL", false), "Whether the process must fail without archiving anything when some log streams cannot be downloaded.")
+	flagSet.BoolVar(&keepEmpty, "keep-empty", getEnvBool("KEEP_EMPTY", false), "Whether log streams without any event must be archived as empty files.")
+	flagSet.BoolVar(&keepWorkspace, "keep-workspace", getEnvBool("KEEP_WORKSPACE", false), "Whether the workspace must be kept after the run, even if it is interrupted.")
+	flagSet.BoolVar(&cleanWorkspace, "clean", getEnvBool("CLEAN_WORKSPACE", false), "Whether the workspace must be removed at the end of the run.")
+	flagSet.BoolVar(&uploadEmpty, "upload-empty", getEnvBool("UPLOAD_EMPTY", false), "Whether an archive must be uploaded even if there is no log stream.")
+	flagSet.IntVar(&describeLimit, "describe-limit", getEnvInt("DESCRIBE_LIMIT", maxDescribeLimit), "The number of log streams described per page (at most 50).")
+	flagSet.IntVar(&streamParallelism, "stream-parallelism", getEnvInt("STREAM_PARALLELISM", 1), "The number of time windows fetched concurrently for each log stream.")
+	flagSet.IntVar(&writeBufferBytes, "write-buffer-bytes", getEnvInt("WRITE_BUFFER_BYTES", 64*1024), "The size of the buffer used to write each log file.")
+	flagSet.BoolVar(&fromTail, "from-tail", getEnvBool("FROM_TAIL", false), "Whether log streams must be read from the most recent events, producing a descending archive.")
+	flagSet.BoolVar(&encodeBinary, "encode-binary", getEnvBool("ENCODE_BINARY", false), "Whether messages which are not valid text must be base64-encoded.")
+	flagSet.BoolVar(&mergeMode, "merge", getEnvBool("MERGE_STREAMS", false), "Whether all log streams must be merged into a single file sorted by timestamp.")
+	flagSet.BoolVar(&mergePrefix, "merge-prefix", getEnvBool("MERGE_PREFIX", false), "Whether merged lines must be prefixed with the name of their log stream.")
+	flagSet.BoolVar(&includeTimestamps, "include-timestamps", getEnvBool("INCLUDE_TIMESTAMPS", false), "Whether each message must be prefixed with its event timestamp.")
+	flagSet.BoolVar(&includeIngestionTime, "include-ingestion-time", getEnvBool("INCLUDE_INGESTION_TIME", false), "Whether the ingestion time must follow the event timestamp (requires include-timestamps).")
+	flagSet.StringVar(&terminatorName, "line-terminator", getEnv("LINE_TERMINATOR", "lf"), "The terminator of each line, either lf, crlf or an escaped sequence (e.g. \"\\x1e\").")
+	flagSet.StringVar(&projectionQuery, "jq", os.Getenv("JQ_PROJECTION"), "The jq expression projecting JSON messages (e.g. \"{level, msg}\").")
+	flagSet.BoolVar(&dropNonJSON, "jq-drop-invalid", getEnvBool("JQ_DROP_INVALID", false), "Whether messages which cannot be projected (e.g. not JSON) must be dropped instead of kept as is.")
+	flagSet.StringVar(&dropPatterns, "drop-pattern", os.Getenv("DROP_PATTERNS"), "The regular expressions (comma-separated) of the messages which must not be archived.")
+	flagSet.StringVar(&redactList, "redact", os.Getenv("REDACT_RULES"), "The redaction rules (comma-separated regex=replacement pairs) applied in order to each message.")
+	flagSet.StringVar(&fieldDelimiter, "field-delimiter", getEnv("FIELD_DELIMITER", " "), "The delimiter between the timestamps and the message.")
+	flagSet.Int64Var(&splitThreshold, "split-threshold", int64(getEnvInt("SPLIT_THRESHOLD", 0)), "The number of events beyond which a log stream is downloaded hour by hour (disabled if zero).")
+	flagSet.BoolVar(&watermarkMode, "watermark", getEnvBool("WATERMARK", false), "Whether only the events after the watermark of the previous run must be archived (incremental mode).")
+	flagSet.DurationVar(&settleWait, "settle-wait", getEnvDuration("SETTLE_WAIT", 0), "The time without any ingested event to wait for before downloading (disabled if zero).")
+	flagSet.DurationVar(&safetyMargin, "safety-margin", getEnvDuration("SAFETY_MARGIN", 0), "The time kept before the deadline to archive and upload the logs downloaded so far (disabled if zero).")
+	flagSet.DurationVar(&apiTimeout, "api-timeout", getEnvDuration("API_TIMEOUT", 30*time.Second), "The timeout of each CloudWatch API call, timed out calls being retried (disabled if zero).")
+	flagSet.DurationVar(&dialTimeout, "dial-timeout", getEnvDuration("DIAL_TIMEOUT", 0), "The timeout of the connections (DNS resolution included) to AWS services (SDK default if zero).")
+	flagSet.DurationVar(&tlsTimeout, "tls-handshake-timeout", getEnvDuration("TLS_HANDSHAKE_TIMEOUT", 0), "The timeout of the TLS handshakes with AWS services (SDK default if zero).")
+	flagSet.DurationVar(&httpTimeout, "http-timeout", getEnvDuration("HTTP_TIMEOUT", 0), "The overall timeout of each HTTP request to AWS services, body transfer included (disabled if zero).")
+	flagSet.IntVar(&maxRetries, "max-retries", getEnvInt("MAX_RETRIES", 4), "The number of times a failed AWS call is retried.")
+	flagSet.DurationVar(&retryBaseDelay, "retry-base-delay", getEnvDuration("RETRY_BASE_DELAY", 200*time.Millisecond), "The delay before the first retry, doubled after each attempt.")
+	flagSet.DurationVar(&retryMaxDelay, "retry-max-delay", getEnvDuration("RETRY_MAX_DELAY", 5*time.Second), "The maximum delay between two retries.")
+	flagSet.StringVar(&retriableCodeList, "retriable-codes", os.Getenv("RETRIABLE_CODES"), "The additional AWS error codes (comma-separated) which must be retried.")
+	flagSet.DurationVar(&progressInterval, "progress-interval", getEnvDuration("PROGRESS_INTERVAL", 0), "The interval between two progress logs during downloads (disabled if zero).")
+	flagSet.StringVar(&archiveFormat, "format", getEnv("ARCHIVE_FORMAT", "gzip"), "The compression format of the archive, either gzip, bzip2, snappy or none.")
+	flagSet.BoolVar(&noCompression, "no-compression", getEnvBool("NO_COMPRESSION", false), "Whether the archive must be a plain tarball, as with the none format.")
+	flagSet.BoolVar(&parallelGzip, "parallel-gzip", getEnvBool("PARALLEL_GZIP", false), "Whether the archive must be compressed with several goroutines.")
+	flagSet.StringVar(&gzipComment, "gzip-comment", os.Getenv("GZIP_COMMENT"), "The comment written into the headers of gzip files (Latin-1 text).")
+	flagSet.BoolVar(&reproducible, "reproducible", getEnvBool("REPRODUCIBLE", false), "Whether tar headers must use fixed metadata so that identical logs produce identical archives.")
+	flagSet.BoolVar(&includeReadme, "include-readme", getEnvBool("INCLUDE_README", false), "Whether a README describing the archive and how to extract it must be included in the tarball.")
+	flagSet.BoolVar(&chunked, "chunked", getEnvBool("CHUNKED", false), "Whether the logs must be split into several archives compressed and uploaded concurrently, along with an index.")
+	flagSet.IntVar(&chunkCount, "chunks", getEnvInt("CHUNKS", 4), "The number of chunk archives into which the logs are split in chunked mode.")
+	flagSet.IntVar(&chunkWorkers, "chunk-workers", getEnvInt("CHUNK_WORKERS", 4), "The maximum number of chunk archives created and uploaded concurrently in chunked mode.")
+	flagSet.BoolVar(&perFileGzip, "per-file-gzip", getEnvBool("PER_FILE_GZIP", false), "Whether each log stream must be gzipped into a \".log.gz\" file while being downloaded.")
+	flagSet.IntVar(&compressionConcurrency, "compression-concurrency", getEnvInt("COMPRESSION_CONCURRENCY", runtime.NumCPU()), "The number of log files compressed concurrently with per-file-gzip.")
+	flagSet.StringVar(&partitionStyle, "partition-style", getEnv("PARTITION_STYLE", "flat"), "The layout of the S3 keys, either flat or hive (year=/month=/day= prefixes).")
+	flagSet.IntVar(&tarUID, "tar-uid", getEnvInt("TAR_UID", 0), "The user ID owning the entries of the tarball.")
+	flagSet.IntVar(&tarGID, "tar-gid", getEnvInt("TAR_GID", 0), "The group ID owning the entries of the tarball.")
+	flagSet.StringVar(&tarUname, "tar-uname", getEnv("TAR_UNAME", "root"), "The user name owning the entries of the tarball.")
+	flagSet.StringVar(&tarGname, "tar-gname", getEnv("TAR_GNAME", "root"), "The group name owning the entries of the tarball.")
+	flagSet.StringVar(&tarPrefix, "tar-prefix", os.Getenv("TAR_PREFIX"), "The directory of the entries in the tarball, where {env} and {date} are replaced (e.g. \"{env}/{date}\").")
+	flagSet.Int64Var(&maxTotalBytes, "max-total-bytes", int64(getEnvInt("MAX_TOTAL_BYTES", 0)), "The maximum size of the compressed archive, the process failing before any upload beyond it (0 for no limit).")
+	flagSet.Int64Var(&minArchiveBytes, "min-archive-bytes", int64(getEnvInt("MIN_ARCHIVE_BYTES", 0)), "The minimum size of the compressed archive, below which the process fails (0 for no minimum).")
+	flagSet.StringVar(&minArchiveCheck, "min-archive-check", getEnv("MIN_ARCHIVE_CHECK", "before"), "When a too small archive makes the process fail, either \"before\" or \"after\" its upload.")
+	flagSet.BoolVar(&noTar, "no-tar", getEnvBool("NO_TAR", false), "Whether the single log stream must be directly gzipped into a \".log.gz\" file.")
+	flagSet.StringVar(&insightsQuery, "insights-query", os.Getenv("INSIGHTS_QUERY"), "The CloudWatch Logs Insights query whose results are archived instead of the log streams.")
+	flagSet.StringVar(&insightsFormat, "insights-format", getEnv("INSIGHTS_FORMAT", "json"), "The format of the Insights query results (json or csv).")
+	flagSet.IntVar(&insightsLimit, "insights-limit", getEnvInt("INSIGHTS_LIMIT", maxInsightsLimit), "The maximum number of results of the Insights query (at most 10000).")
+	flagSet.StringVar(&destinationType, "destination", getEnv("DESTINATION", "s3"), "The storage service of the buckets, either \"s3\" or \"gcs\".")
+	flagSet.StringVar(&webhookURL, "webhook-url", os.Getenv("WEBHOOK_URL"), "The URL to which the JSON run summary is posted on completion.")
+	flagSet.DurationVar(&webhookDelay, "webhook-retry-delay", getEnvDuration("WEBHOOK_RETRY_DELAY", time.Second), "The delay before retrying a failed delivery to the webhook, doubled after each attempt.")
+	flagSet.StringVar(&otelEndpoint, "otel-endpoint", os.Getenv("OTEL_ENDPOINT"), "The OTLP/HTTP endpoint to which OpenTelemetry spans and metrics are exported.")
+	flagSet.StringVar(&presignedURL, "presigned-url", os.Getenv("PRESIGNED_URL"), "The presigned URL to which the archive must be uploaded with a PUT request, instead of S3 buckets.")
+	flagSet.StringVar(&metadataList, "metadata", os.Getenv("OBJECT_METADATA"), "The metadata (comma-separated key=value pairs) of the archive, along with automatic values.")
+	flagSet.StringVar(&objectACL, "acl", os.Getenv("OBJECT_ACL"), "The canned ACL applied to the uploaded archive.")
+	flagSet.StringVar(&storageClass, "storage-class", os.Getenv("STORAGE_CLASS"), "The S3 storage class of the uploaded archive (e.g. INTELLIGENT_TIERING).")
+	flagSet.StringVar(&expectedBucketOwner, "expected-bucket-owner", os.Getenv("EXPECTED_BUCKET_OWNER"), "The account ID expected to own the S3 bucket.")
+	flagSet.Int64Var(&uploadPartSize, "upload-part-size", int64(getEnvInt("UPLOAD_PART_SIZE", int(s3manager.DefaultUploadPartSize))), "The size in bytes of each part of the multipart upload used with stream-upload (at least 5 MiB).")
+	flagSet.IntVar(&uploadConcurrency, "upload-concurrency", getEnvInt("UPLOAD_CONCURRENCY", s3manager.DefaultUploadConcurrency), "The number of parts uploaded concurrently with stream-upload.")
+	flagSet.Int64Var(&maxMemoryBytes, "max-memory-bytes", int64(getEnvInt("MAX_MEMORY_BYTES", 0)), "The soft limit of the memory used to buffer logs, beyond which they are spilled to the workspace (0 for no limit).")
+	flagSet.BoolVar(&streamUpload, "stream-upload", getEnvBool("STREAM_UPLOAD", false), "Whether the archive must be uploaded while being generated instead of being staged on disk.")
+	flagSet.BoolVar(&writeChecksumFile, "write-checksum-file", getEnvBool("WRITE_CHECKSUM_FILE", false), "Whether a \".sha256\" sidecar object must be uploaded next to the archive.")
+	flagSet.BoolVar(&precheckBucket, "precheck-bucket", getEnvBool("PRECHECK_BUCKET", true), "Whether the buckets must be checked before downloading any log, failing fast if they are not accessible.")
+	flagSet.BoolVar(&overwrite, "overwrite", getEnvBool("OVERWRITE", true), "Whether an existing archive can be overwritten, the upload failing otherwise.")
+	flagSet.BoolVar(&verifyUpload, "verify-upload", getEnvBool("VERIFY_UPLOAD", false), "Whether the uploaded archive must be downloaded again to verify its checksum.")
+	flagSet.DurationVar(&verifyTimeout, "verify-timeout", getEnvDuration("VERIFY_TIMEOUT", 5*time.Minute), "The timeout of the verification of each uploaded archive, which downloads it again (disabled if zero).")
+}
+
+// Exit codes of the CLI, allowing scripts to distinguish partial failures from total ones.
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitPartial = 3
+)
+
+// RunCLI runs the archiving process from the command line, aborting it cleanly on SIGINT or SIGTERM, and returns the
+// exit code of the process.
+func RunCLI() (code int) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Invalid options and fatal errors are reported as total failures rather than with the exit code of a panic.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(r)
+			code = exitFailure
+		}
+	}()
+
+	defer func() {
+		if ctx.Err() != nil && !keepWorkspace {
+			log.Println("Archiving process interrupted, removing the workspace.")
+			check(os.RemoveAll(workspace))
+		}
+	}()
+
+	summary, err := LambdaHandler(ctx, ScheduledEvent{})
+	if errors.Is(err, flag.ErrHelp) {
+		return exitSuccess
+	}
+
+	output, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(output))
+
+	if err != nil {
+		log.Println(err)
+	}
+
+	return exitCode(summary, err)
+}
+
+// exitCode derives the exit code of the CLI from the run summary: a run is partial when some uploads, log groups or log
+// streams failed while others succeeded.
+func exitCode(summary RunSummary, err error) int {
+	succeeded, failed := summaryOutcomes(summary)
+	switch {
+	case err != nil && succeeded == 0:
+		return exitFailure
+	case err != nil || failed > 0:
+		return exitPartial
+	default:
+		return exitSuccess
+	}
+}
+
+// summaryOutcomes counts the successful and failed uploads of a run summary, including those of its log groups, skipped
+// log streams being counted as failures.
+func summaryOutcomes(summary RunSummary) (int, int) {
+	succeeded, failed := 0, len(summary.FailedStreams)
+	for _, result := range summary.Buckets {
+		if len(result.Error) > 0 {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+
+	// Uploads are not successes when every log stream failed, as the archive holds no log at all.
+	if summary.Streams > 0 && len(summary.FailedStreams) == summary.Streams {
+		succeeded = 0
+	}
+
+	for _, group := range summary.Groups {
+		groupSucceeded, groupFailed := summaryOutcomes(group)
+		if len(group.Error) > 0 {
+			groupFailed++
+		}
+		succeeded, failed = succeeded+groupSucceeded, failed+groupFailed
+	}
+
+	return succeeded, failed
+}
+
+// partialOutcome turns the error of a partial run (e.g. some log streams or log groups failed) into a success when
+// partial runs must not be retried by the scheduler, runs without any successful upload or with a too small archive still
+// failing.
+func partialOutcome(summary RunSummary, err error) error {
+	if err == nil || !partialIsSuccess || errors.Is(err, errArchiveTooSmall) {
+		return err
+	}
+
+	if succeeded, _ := summaryOutcomes(summary); succeeded == 0 {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("The run partially failed, it is nevertheless reported as a success: %v", err))
+
+	return nil
+}
+
+// RunSummary describes the outcome of an archiving process.
+type RunSummary struct {
+	Environment    string         `json:"environment,omitempty"`
+	LogGroup       string         `json:"log_group,omitempty"`
+	StartDate      time.Time      `json:"start_date"`
+	EndDate        time.Time      `json:"end_date"`
+	Streams        int            `json:"streams"`
+	Events         int64          `json:"events"`
+	Bytes          int64          `json:"bytes"`
+	Encoded        int64          `json:"encoded"`
+	FailedStreams  []string       `json:"failed_streams,omitempty"`
+	StreamResults  []StreamResult `json:"stream_results,omitempty"`
+	Dropped        int64          `json:"dropped,omitempty"`
+	Redacted       int64          `json:"redacted,omitempty"`
+	NilMessages    int64          `json:"nil_messages,omitempty"`
+	Truncated      bool           `json:"truncated,omitempty"`
+	Uploaded       bool           `json:"uploaded"`
+	EstimatedBytes int64          `json:"estimated_bytes,omitempty"`
+	Key            string         `json:"key,omitempty"`
+	Checksum       string         `json:"checksum,omitempty"`
+	Buckets        []BucketResult `json:"buckets,omitempty"`
+	Permissions    []Permission   `json:"permissions,omitempty"`
+	Groups         []RunSummary   `json:"groups,omitempty"`
+	Skipped        string         `json:"skipped,omitempty"`
+	Diagnostics    *Diagnostics   `json:"diagnostics,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// Diagnostics describes the environment which produced an archive, and the resources used by the Go runtime.
+type Diagnostics struct {
+	Region          string `json:"region,omitempty"`
+	MemorySize      int    `json:"memory_size_mb,omitempty"`
+	FunctionVersion string `json:"function_version,omitempty"`
+	GoVersion       string `json:"go_version"`
+	CPUs            int    `json:"cpus"`
+	Goroutines      int    `json:"goroutines"`
+	HeapAlloc       uint64 `json:"heap_alloc_bytes"`
+	Sys             uint64 `json:"sys_bytes"`
+	NumGC           uint32 `json:"num_gc"`
+}
+
+// StreamResult describes the outcome of the download of a log stream.
+type StreamResult struct {
+	Name      string `json:"name"`
+	Events    int64  `json:"events"`
+	Bytes     int64  `json:"bytes"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BucketResult describes the outcome of the upload to a destination bucket.
+type BucketResult struct {
+	Bucket string `json:"bucket"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Permission describes whether an action required by the archiving process is allowed, as checked by the self-check.
+type Permission struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Allowed  bool   `json:"allowed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ScheduledEvent is the payload of a scheduled invocation, either a CloudWatch Events rule or an EventBridge Scheduler
+// schedule whose input provides the scheduled time (e.g. {"time": "<aws.scheduler.scheduled-time>"}).
+type ScheduledEvent struct {
+	Time time.Time `json:"time"`
+}
+
+// LambdaHandler handles the archiving process called by AWS Lambda.
+func LambdaHandler(ctx context.Context, event ScheduledEvent) (summary RunSummary, err error) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	defer recoverError(&err)
+
+	scheduledTime = event.Time
+	loadFlagValues()
+
+	return run(ctx)
+}
+
+// Config holds the options of a run, keyed by flag names as in configuration files (e.g. "bucket" or "environment").
+type Config map[string]string
+
+// ObjectRef locates an uploaded archive.
+type ObjectRef struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	Checksum string `json:"checksum"`
+}
+
+// ArchiveGroup runs the archiving process with the given options instead of the command line, the options which are not
+// provided keeping their environment or default value. Runs share the state of the package (options, clients and
+// workspace), concurrent calls are therefore run one after the other.
+func ArchiveGroup(ctx context.Context, cfg Config) (summary RunSummary, err error) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	defer recoverError(&err)
+
+	scheduledTime = time.Time{}
+	loadConfig(cfg)
+
+	return run(ctx)
+}
+
+// ArchiveStream archives a single log stream of a log group with the given options, and returns the uploaded archive.
+// Without any environment, the archive is keyed by the name of the log group as with the log-group-prefix option.
+func ArchiveStream(ctx context.Context, cfg Config, group string, stream string) (ref ObjectRef, err error) {
+	defer recoverError(&err)
+
+	if len(group) == 0 || len(stream) == 0 {
+		return ObjectRef{}, errors.New("a log group and a log stream must be provided")
+	}
+
+	options := Config{"log-group-template": group, "streams": stream}
+	if len(cfg["environment"]) == 0 && len(flagSet.Lookup("environment").DefValue) == 0 {
+		options["environment"] = groupKeyPrefix(group)
+	}
+	for name, value := range cfg {
+		if _, ok := options[name]; !ok {
+			options[name] = value
+		}
+	}
+
+	summary, err := ArchiveGroup(ctx, options)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+
+	for _, result := range summary.Buckets {
+		if len(result.Error) == 0 {
+			return ObjectRef{Bucket: result.Bucket, Key: summary.Key, Checksum: summary.Checksum}, nil
+		}
+	}
+
+	return ObjectRef{}, fmt.Errorf("the \"%s\" log stream has not been archived", stream)
+}
+
+// recoverError converts a panic of the archiving process into an error, so that it does not crash the calling service.
+func recoverError(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if recovered, ok := r.(error); ok {
+		*err = recovered
+	} else {
+		*err = fmt.Errorf("%v", r)
+	}
+}
+
+// run runs the archiving process once the options have been loaded.
+func run(ctx context.Context) (summary RunSummary, err error) {
+	logInfo("Start of the logs archiving process.")
+
+	// Fatal errors are also delivered to the webhook, before being propagated.
+	defer func() {
+		if r := recover(); r != nil {
+			notifyWebhook(ctx, summary, fmt.Errorf("%v", r))
+			panic(r)
+		}
+		notifyWebhook(ctx, summary, err)
+		err = partialOutcome(summary, err)
+	}()
+	defer addDiagnostics(&summary)
+
+	loadServices()
+	defer flushTelemetry(ctx)
+	check(precheckBuckets(ctx))
+
+	check(lockWorkspace(ctx))
+	defer unlockWorkspace()
+	defer releaseWorkspace()
+
+	if len(logGroupPrefix) > 0 && groupTree {
+		return archiveTree(ctx)
+	}
+	if len(logGroupPrefix) > 0 {
+		return archiveGroups(ctx)
+	}
+
+	return archiveGroup(ctx)
+}
+
+// addDiagnostics adds the Lambda environment and the Go runtime statistics to the summary when diagnostics are enabled,
+// statistics being collected at the end of the run.
+func addDiagnostics(summary *RunSummary) {
+	if !diagnostics {
+		return
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	memorySize, _ := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+
+	summary.Diagnostics = &Diagnostics{
+		Region:          getEnv("AWS_REGION", region),
+		MemorySize:      memorySize,
+		FunctionVersion: os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		GoVersion:       runtime.Version(),
+		CPUs:            runtime.NumCPU(),
+		Goroutines:      runtime.NumGoroutine(),
+		HeapAlloc:       memStats.HeapAlloc,
+		Sys:             memStats.Sys,
+		NumGC:           memStats.NumGC,
+	}
+}
+
+// precheckBuckets makes sure that every destination bucket exists and is accessible before any log is downloaded.
+func precheckBuckets(ctx context.Context) error {
+	if !precheckBucket || destinationType != "s3" || dryRun || selfCheck || listStreamsMode {
+		return nil
+	}
+
+	for _, destination := range buckets {
+		// Directory buckets are only reachable with the session authentication of the second version of the SDK.
+		if isDirectoryBucket(destination) {
+			continue
+		}
+
+		if err := checkBucket(ctx, destination); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkBucket sends a HeadBucket request, missing buckets and denied accesses being reported as such.
+func checkBucket(ctx context.Context, destination string) error {
+	client, err := s3Client(ctx, destination)
+	if err == nil {
+		_, err = client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(destination)})
+	}
+
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("the \"%s\" bucket does not exist", destination)
+	}
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusForbidden {
+		return fmt.Errorf("access to the \"%s\" bucket is denied", destination)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check the \"%s\" bucket, %v", destination, err)
+	}
+
+	return nil
+}
+
+// notifyWebhook posts the run summary to the webhook, server errors being retried until the run is canceled. Delivery
+// failures are only logged, the outcome of the run being unchanged.
+func notifyWebhook(ctx context.Context, summary RunSummary, err error) {
+	if len(webhookURL) == 0 {
+		return
+	}
+
+	if err != nil && len(summary.Error) == 0 {
+		summary.Error = err.Error()
+	}
+	payload, marshalErr := json.Marshal(summary)
+	check(marshalErr)
+
+	delay := webhookDelay
+	for attempt := 1; ; attempt++ {
+		retryable, postErr := postWebhook(payload)
+		if postErr == nil {
+			logInfo("Run summary successfully delivered to the webhook.")
+			return
+		}
+		if !retryable || attempt == webhookAttempts {
+			log.Println(fmt.Sprintf("Failed to deliver the run summary to the webhook, %v", postErr))
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println(fmt.Sprintf("Failed to deliver the run summary to the webhook, %v", postErr))
+			return
+		case <-after(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postWebhook sends the payload to the webhook, and tells whether a failure is worth retrying. The webhook is called
+// even if the run has been canceled, and its URL is stripped from errors as it may contain a secret.
+func postWebhook(payload []byte) (bool, error) {
+	duration, _ := time.ParseDuration(timeout)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), duration)
+	defer cancelFn()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, errors.Unwrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode >= http.StatusInternalServerError, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	return false, nil
+}
+
+// archiveGroups discovers all log groups matching the prefix and archives each of them into its own object.
+func archiveGroups(ctx context.Context) (RunSummary, error) {
+	summary := RunSummary{StartDate: startDate, EndDate: endDate, Uploaded: true}
+
+	// The environment is only borrowed by each group, warm invocations must not find it set next to the prefix.
+	defer restoreEnvironment(environment)
+
+	logGroups := discoverLogGroups(ctx)
+
+	failures := 0
+	for _, group := range logGroups {
+		if ctx.Err() != nil {
+			return summary, ctx.Err()
+		}
+
+		// Each discovered log group is archived as if it was an environment on its own, named after the group.
+		environment, logGroup = groupKeyPrefix(group), group
+
+		groupSummary, err := archiveGroup(ctx)
+		if err != nil {
+			log.Println(err)
+			groupSummary.Error = err.Error()
+			failures++
+		}
+
+		summary.Uploaded = summary.Uploaded && groupSummary.Uploaded
+		summary.Groups = append(summary.Groups, groupSummary)
+	}
+
+	if failures > 0 {
+		return summary, fmt.Errorf("failed to archive %d log groups out of %d", failures, len(logGroups))
+	}
+
+	return summary, nil
+}
+
+// restoreEnvironment restores the environment flag once the discovered log groups have been archived under their own
+// key prefix.
+func restoreEnvironment(value string) {
+	environment = value
+}
+
+// discoverLogGroups retrieves the names of all log groups matching the prefix.
+func discoverLogGroups(ctx context.Context) []string {
+	var logGroups []string
+	err := cwService.DescribeLogGroupsPagesWithContext(ctx, &cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(logGroupPrefix),
+	}, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, group := range page.LogGroups {
+			logGroups = append(logGroups, aws.StringValue(group.LogGroupName))
+		}
+		return true
+	})
+	check(err)
+
+	logInfo(fmt.Sprintf("%d log groups found with the \"%s\" prefix.", len(logGroups), logGroupPrefix))
+
+	return logGroups
+}
+
+// retentionCovers checks whether the retention of the current log group already meets the min-retention-days flag, in
+// which case the reason to skip archiving is returned. Log groups whose events never expire are always covered.
+func retentionCovers(ctx context.Context) string {
+	if minRetentionDays == 0 || force {
+		return ""
+	}
+
+	var reason string
+	err := cwService.DescribeLogGroupsPagesWithContext(ctx, &cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(logGroup),
+	}, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, group := range page.LogGroups {
+			if group == nil || aws.StringValue(group.LogGroupName) != logGroup {
+				continue
+			}
+
+			if group.RetentionInDays == nil {
+				reason = "its events never expire"
+			} else if days := aws.Int64Value(group.RetentionInDays); days >= int64(minRetentionDays) {
+				reason = fmt.Sprintf("its retention of %d days covers the %d required days", days, minRetentionDays)
+			}
+			return false
+		}
+		return true
+	})
+	check(err)
+
+	return reason
+}
+
+// archiveGroup archives the logs of the current log group.
+func archiveGroup(ctx context.Context) (RunSummary, error) {
+	logInfo(fmt.Sprintf("Archiving the \"%s\" log group.", logGroup))
+
+	summary := RunSummary{Environment: environment, LogGroup: logGroup, StartDate: startDate, EndDate: endDate}
+	truncated = false
+	if listMode {
+		return summary, listArchives(ctx)
+	}
+
+	if listStreamsMode {
+		return summary, listStreams(ctx)
+	}
+
+	if selfCheck {
+		return summary, checkPermissions(ctx, &summary)
+	}
+
+	if dryRun {
+		return summary, estimateStreams(ctx, &summary)
+	}
+
+	if summary.Skipped = retentionCovers(ctx); len(summary.Skipped) > 0 {
+		logInfo(fmt.Sprintf("Skipping the \"%s\" log group, %s.", logGroup, summary.Skipped))
+		return summary, nil
+	}
+
+	loadWatermarks(ctx)
+	ok, streamsErr := fetchLogs(ctx, &summary)
+	if !ok {
+		return summary, streamsErr
+	}
+
+	// Downloads stop as soon as the process is canceled, there is no point in archiving partial logs then.
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+
+	err := uploadLogs(ctx, &summary)
+	if summary.Uploaded {
+		err = errors.Join(err, saveWatermarks(ctx))
+	}
+
+	// The successful streams have been archived, the failed ones are still reported as an error.
+	return summary, errors.Join(err, streamsErr)
+}
+
+// uploadLogs archives the downloaded logs and uploads the archive, the summary being completed accordingly.
+func uploadLogs(ctx context.Context, summary *RunSummary) error {
+	var err error
+	summary.Key = archiveKey(archiveName())
+	archiveMetadata = objectMetadata(*summary)
+	check(writeReadme())
+	if streamUpload && !spillArchive() {
+		err = streamArchive(ctx, summary)
+	} else {
+		err = stageArchive(ctx, summary)
+	}
+	// A too small archive checked after its upload is still in the buckets, only its size check has failed.
+	summary.Uploaded = err == nil || errors.Is(err, errArchiveTooSmall)
+
+	return err
+}
+
+// archiveTree archives all log groups matching the prefix into a single archive, the files of each group being stored
+// under a directory mirroring its name (e.g. "svc/a/worker/").
+func archiveTree(ctx context.Context) (RunSummary, error) {
+	logGroups := discoverLogGroups(ctx)
+
+	defer restoreEnvironment(environment)
+	environment = groupKeyPrefix(logGroupPrefix)
+	summary := RunSummary{Environment: environment, LogGroup: logGroupPrefix, StartDate: startDate, EndDate: endDate}
+	prepareWorkspace()
+
+	files, err := downloadTree(ctx, &summary, logGroups)
+	if err != nil && failOnPartial {
+		return summary, err
+	}
+
+	// Downloads stop as soon as the process is canceled, there is no point in archiving partial logs then.
+	if ctx.Err() != nil {
+		return summary, ctx.Err()
+	}
+
+	streamFiles = files
+	if uploadErr := uploadLogs(ctx, &summary); uploadErr != nil {
+		return summary, uploadErr
+	}
+
+	return summary, err
+}
+
+// downloadTree downloads the log streams of every log group into its own workspace directory, and returns the stream
+// of each workspace file. Failed groups are reported in the summary without stopping the others.
+func downloadTree(ctx context.Context, summary *RunSummary, logGroups []string) (map[string]string, error) {
+	defer func() { groupDirectory = "" }()
+
+	files := make(map[string]string)
+	partial := false
+	var errs []error
+	for _, group := range logGroups {
+		logGroup = group
+		groupDirectory = strings.TrimPrefix(path.Clean("/"+group), "/") + "/"
+
+		groupSummary := RunSummary{LogGroup: group, StartDate: startDate, EndDate: endDate}
+		streamFiles = nil
+		if _, err := downloadStreams(ctx, &groupSummary); err != nil {
+			groupSummary.Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to download the \"%s\" log group, %v", group, err))
+		}
+		for file, stream := range streamFiles {
+			files[groupDirectory+file] = stream
+		}
+
+		partial = partial || groupSummary.Truncated
+		summary.Streams += groupSummary.Streams
+		summary.Events += groupSummary.Events
+		summary.Bytes += groupSummary.Bytes
+		summary.Groups = append(summary.Groups, groupSummary)
+	}
+	truncated = partial
+	summary.Truncated = partial
+
+	return files, errors.Join(errs...)
+}
+
+// checkPermissions performs a minimal call of each action required by the archiving process, and reports the actions
+// which are not allowed. A tiny probe object is written into every destination bucket, then removed.
+func checkPermissions(ctx context.Context, summary *RunSummary) error {
+	summary.Permissions = append(summary.Permissions, checkPermission("logs:DescribeLogStreams", logGroup, func() error {
+		_, err := logsService.DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+			LogGroupName: aws.String(logGroup),
+			Limit:        aws.Int64(1),
+		})
+		return err
+	}))
+
+	// Other destinations are not checked, as they do not rely on AWS permissions.
+	probed := buckets
+	if destinationType != "s3" {
+		probed = nil
+	}
+
+	for _, destination := range probed {
+		client, clientErr := s3Client(ctx, destination)
+		summary.Permissions = append(summary.Permissions, checkPermission("s3:HeadBucket", destination, func() error {
+			if clientErr != nil {
+				return clientErr
+			}
+			_, err := client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(destination)})
+			return err
+		}))
+		summary.Permissions = append(summary.Permissions, checkPermission("s3:PutObject", destination, func() error {
+			if clientErr != nil {
+				return clientErr
+			}
+			return probeBucket(ctx, client, destination)
+		}))
+	}
+
+	denied := 0
+	for _, permission := range summary.Permissions {
+		if !permission.Allowed {
+			denied++
+		}
+	}
+	if denied > 0 {
+		return fmt.Errorf("the self-check failed, %d of %d actions are not allowed", denied, len(summary.Permissions))
+	}
+
+	logInfo("Self-check succeeded, all actions are allowed.")
+
+	return nil
+}
+
+// probeBucket writes the probe object of the self-check into a bucket, and removes it right away so that nothing is left
+// behind. The archiving process does not need to delete objects, a failed removal is therefore only logged.
+func probeBucket(ctx context.Context, client *s3.S3, destination string) error {
+	objects := newObjectsAPI(client)
+	key := archivePrefix() + ".selfcheck"
+	if err := objects.PutObject(ctx, putObjectInput(destination, key, strings.NewReader("ok"))); err != nil {
+		return err
+	}
+
+	input := &s3.DeleteObjectInput{Bucket: aws.String(destination), Key: aws.String(key)}
+	if len(expectedBucketOwner) > 0 {
+		input.ExpectedBucketOwner = aws.String(expectedBucketOwner)
+	}
+	if err := objects.DeleteObject(ctx, input); err != nil {
+		log.Println(fmt.Sprintf("Unable to remove the self-check probe from \"%s\", %v", destination, err))
+	}
+
+	return nil
+}
+
+// checkPermission calls an action and describes whether it is allowed, access errors being reported as missing
+// permissions.
+func checkPermission(action string, resource string, call func() error) Permission {
+	permission := Permission{Action: action, Resource: resource, Allowed: true}
+	if err := call(); err != nil {
+		permission.Allowed = false
+		permission.Error = err.Error()
+		if aerr, ok := err.(awserr.Error); ok && strings.HasPrefix(aerr.Code(), "AccessDenied") {
+			permission.Error = "missing permission, " + aerr.Message()
+		}
+		log.Println(fmt.Sprintf("The \"%s\" action is not allowed on \"%s\", %s", action, resource, permission.Error))
+	}
+
+	return permission
+}
+
+// stageArchive creates the archive into the workspace before uploading it to every destination bucket.
+func stageArchive(ctx context.Context, summary *RunSummary) error {
+	if chunked {
+		return stageChunks(ctx, summary)
+	}
+
+	archive, err := os.Create(stagedArchivePath())
+	check(err)
+	defer archive.Close()
+
+	check(traceStage(ctx, "archive", func(context.Context) error {
+		return archiveLogs(archive)
+	}))
+	summary.Checksum, err = archiveChecksum(archive)
+	check(err)
+
+	tooSmall := checkArchiveSize(archive)
+	if tooSmall != nil && minArchiveCheck == "before" {
+		return tooSmall
+	}
+
+	if len(presignedURL) > 0 {
+		err = uploadPresigned(ctx, archive)
+	} else {
+		summary.Buckets, err = uploadArchives(ctx, archive, summary.Key, summary.Checksum)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tooSmall
+}
+
+// stagedArchivePath returns the workspace path of the archive staged before its upload. Layouts such as 2006/01/02
+// produce S3 prefixes, the local file only uses the last element of the name.
+func stagedArchivePath() string {
+	return workspace + string(os.PathSeparator) + path.Base(archiveName())
+}
+
+// checkArchiveSize returns an error when the archive is smaller than the min-archive-bytes flag, which usually reveals
+// a run that silently failed to download the logs.
+func checkArchiveSize(archive *os.File) error {
+	if minArchiveBytes == 0 {
+		return nil
+	}
+
+	info, err := archive.Stat()
+	check(err)
+
+	if info.Size() < minArchiveBytes {
+		return fmt.Errorf("%w (%d bytes, less than %d)", errArchiveTooSmall, info.Size(), minArchiveBytes)
+	}
+
+	return nil
+}
+
+// chunkIndex lists the chunk archives of a day, uploaded next to them in chunked mode.
+type chunkIndex struct {
+	Chunks []chunkEntry `json:"chunks"`
+}
+
+// chunkEntry describes a chunk archive and the files it contains.
+type chunkEntry struct {
+	Key      string   `json:"key"`
+	Checksum string   `json:"checksum"`
+	Files    []string `json:"files"`
+}
+
+// archivedFile is a workspace file which must be added to an archive.
+type archivedFile struct {
+	path string
+	info os.FileInfo
+}
+
+// stageChunks splits the downloaded logs into several archives, which are compressed and uploaded concurrently by at
+// most chunkWorkers goroutines, then uploads an index listing them.
+func stageChunks(ctx context.Context, summary *RunSummary) error {
+	name := archiveBaseName() + ".index.json"
+	summary.Key = archiveKey(name)
+
+	chunks := splitChunks(chunkCount)
+
+	index := chunkIndex{Chunks: make([]chunkEntry, len(chunks))}
+	results := make([][]BucketResult, len(chunks)+1)
+	errs := make([]error, len(chunks))
+	workers := make(chan struct{}, chunkWorkers)
+	var wg sync.WaitGroup
+	for i, files := range chunks {
+		wg.Add(1)
+		go func(i int, files []archivedFile) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			index.Chunks[i], results[i], errs[i] = stageChunk(ctx, i, files)
+		}(i, files)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		summary.Buckets = mergeBucketResults(results)
+		return err
+	}
+
+	content, err := json.MarshalIndent(index, "", "  ")
+	check(err)
+
+	archive, err := os.Create(workspace + string(os.PathSeparator) + path.Base(name))
+	check(err)
+	defer archive.Close()
+
+	_, err = archive.Write(content)
+	check(err)
+
+	summary.Checksum, err = archiveChecksum(archive)
+	check(err)
+
+	results[len(chunks)], err = uploadArchives(ctx, archive, summary.Key, summary.Checksum)
+	summary.Buckets = mergeBucketResults(results)
+
+	return err
+}
+
+// stageChunk creates and uploads a chunk archive made of the given files.
+func stageChunk(ctx context.Context, i int, files []archivedFile) (chunkEntry, []BucketResult, error) {
+	name := fmt.Sprintf("%s.part%03d.tar%s", archiveBaseName(), i+1, formatExtensions[archiveFormat])
+	entry := chunkEntry{Key: archiveKey(name)}
+	for _, file := range files {
+		entry.Files = append(entry.Files, file.info.Name())
+	}
+
+	archive, err := os.Create(workspace + string(os.PathSeparator) + path.Base(name))
+	if err != nil {
+		return entry, nil, err
+	}
+	defer archive.Close()
+
+	err = traceStage(ctx, "archive", func(context.Context) error {
+		return archiveFiles(archive, path.Base(name), func(fn func(path string, info os.FileInfo) error) error {
+			for _, file := range files {
+				if err := fn(file.path, file.info); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return entry, nil, fmt.Errorf("failed to create the chunk \"%s\", %v", name, err)
+	}
+
+	if entry.Checksum, err = archiveChecksum(archive); err != nil {
+		return entry, nil, err
+	}
+
+	results, err := uploadArchives(ctx, archive, entry.Key, entry.Checksum)
+
+	return entry, results, err
+}
+
+// splitChunks distributes the workspace files into at most count chunks of similar sizes, each chunk keeping the
+// lexical order of its files. A single empty chunk is returned when there is no file at all.
+func splitChunks(count int) [][]archivedFile {
+	var files []archivedFile
+	check(walkArchivable(func(path string, info os.FileInfo) error {
+		files = append(files, archivedFile{path, info})
+		return nil
+	}))
+
+	bySize := append([]archivedFile(nil), files...)
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return bySize[i].info.Size() > bySize[j].info.Size()
+	})
+
+	// Each file, the largest first, goes to the chunk with the smallest total size.
+	assigned := make(map[string]int, len(files))
+	sizes := make([]int64, count)
+	for _, file := range bySize {
+		smallest := 0
+		for i := range sizes {
+			if sizes[i] < sizes[smallest] {
+				smallest = i
+			}
+		}
+		assigned[file.path] = smallest
+		sizes[smallest] += file.info.Size()
+	}
+
+	chunks := make([][]archivedFile, count)
+	for _, file := range files {
+		chunks[assigned[file.path]] = append(chunks[assigned[file.path]], file)
+	}
+
+	nonEmpty := chunks[:0]
+	for _, chunk := range chunks {
+		if len(chunk) > 0 {
+			nonEmpty = append(nonEmpty, chunk)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return [][]archivedFile{nil}
+	}
+
+	return nonEmpty
+}
+
+// mergeBucketResults combines the upload results of several objects, a bucket keeping the first error it got.
+func mergeBucketResults(results [][]BucketResult) []BucketResult {
+	merged := make([]BucketResult, len(buckets))
+	for i, destination := range buckets {
+		merged[i].Bucket = destination
+	}
+
+	for _, objectResults := range results {
+		for i, result := range objectResults {
+			if len(merged[i].Error) == 0 {
+				merged[i].Error = result.Error
+			}
+		}
+	}
+
+	return merged
+}
+
+// spillArchive checks whether the parts buffered by a streamed upload would exceed the memory limit, in which case the
+// archive is staged in the workspace instead.
+func spillArchive() bool {
+	buffered := uploadPartSize * int64(uploadConcurrency)
+	if maxMemoryBytes == 0 || buffered <= maxMemoryBytes {
+		return false
+	}
+
+	logInfo(fmt.Sprintf("Streaming the archive would buffer %d bytes (more than %d), staging it in the workspace instead.",
+		buffered, maxMemoryBytes))
+	return true
+}
+
+// streamArchive compresses the logs on the fly into the body of a multipart upload, nothing being staged on disk.
+func streamArchive(ctx context.Context, summary *RunSummary) error {
+	destination := buckets[0]
+	summary.Buckets = []BucketResult{{Bucket: destination}}
+
+	checksum, err := streamUploadArchive(ctx, destination, summary.Key)
+	if err != nil {
+		log.Println(err)
+		summary.Buckets[0].Error = err.Error()
+		return err
+	}
+	summary.Checksum = checksum
+
+	return nil
+}
+
+// listArchives prints the archives already uploaded for the environment in every destination bucket.
+func listArchives(ctx context.Context) error {
+	duration, _ := time.ParseDuration(timeout)
+
+	ctx, cancelFn := context.WithTimeout(ctx, duration)
+	defer cancelFn()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "BUCKET\tKEY\tSIZE\tLAST MODIFIED")
+
+	for _, destination := range buckets {
+		client, err := s3Client(ctx, destination)
+		if err != nil {
+			return fmt.Errorf("failed to resolve the region of \"%s\", %v", destination, err)
+		}
+
+		err = client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(destination),
+			Prefix: aws.String(archivePrefix()),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				fmt.Fprintf(writer, "%s\t%s\t%d\t%s\n", destination, aws.StringValue(object.Key),
+					aws.Int64Value(object.Size), aws.TimeValue(object.LastModified).Format(time.RFC3339))
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list the archives of \"%s\", %v", destination, err)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// listStreams prints the log streams of the log group which match the stream filters, along with their activity.
+func listStreams(ctx context.Context) error {
+	logStreams := namedLogStreams
+	if len(streamNames) == 0 {
+		logStreams = describeLogStreams
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "STREAM\tLAST EVENT\tSTORED BYTES\tACTIVE")
+
+	for _, logStream := range logStreams(ctx) {
+		// Explicitly named streams are listed even if they contain access logs, as they would be archived.
+		name := aws.StringValue(logStream.LogStreamName)
+		if len(streamNames) == 0 && isAccessStream(name) {
+			continue
+		}
+
+		lastEvent := "-"
+		if logStream.LastEventTimestamp != nil {
+			lastEvent = fromMillis(*logStream.LastEventTimestamp).Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%t\n", name, lastEvent, aws.Int64Value(logStream.StoredBytes),
+			activeDuring(logStream, startDate, endDate))
+	}
+
+	return writer.Flush()
+}
+
+// fetchLogs writes the results of the Insights query or the log streams into the workspace, returning false if there is
+// nothing to archive or if the process must fail.
+func fetchLogs(ctx context.Context, summary *RunSummary) (bool, error) {
+	if len(insightsQuery) == 0 {
+		return downloadStreams(ctx, summary)
+	}
+
+	prepareWorkspace()
+	var err error
+	summary.Events, err = queryInsights(ctx)
+
+	return err == nil, err
+}
+
+// downloadStreams downloads all selected log streams into the workspace, returning false if there is nothing to archive
+// or if failed streams must fail the whole process. The error lists every failed stream, even if the others can be
+// archived.
+func downloadStreams(ctx context.Context, summary *RunSummary) (bool, error) {
+	logStreams, err := selectLogStreams(ctx)
+	if err != nil {
+		return false, err
+	}
+	summary.Streams = len(logStreams)
+	if len(logStreams) == 0 && !uploadEmpty {
+		logInfo("Nothing to archive, no log stream has been found.")
+		return false, nil
+	}
+
+	checkSingleStream(logStreams)
+	settleStreams(ctx, logStreams)
+	prepareGroupDirectory()
+
+	stats = new(progress)
+	stopProgress := reportProgress(stats, len(logStreams))
+
+	streamFiles = logFileNames(logStreams)
+	streamBufferBytes = fitWriteBuffer(len(logStreams) * streamParallelism)
+
+	summary.StreamResults, summary.FailedStreams, err = downloadAll(ctx, logStreams)
+
+	stopProgress()
+	summary.Events = atomic.LoadInt64(&stats.events)
+	summary.Bytes = atomic.LoadInt64(&stats.bytes)
+	summary.Encoded = atomic.LoadInt64(&stats.encoded)
+	summary.Dropped = atomic.LoadInt64(&stats.dropped)
+	summary.Redacted = atomic.LoadInt64(&stats.redacted)
+	summary.NilMessages = atomic.LoadInt64(&stats.nilMessages)
+	summary.Truncated = truncated
+	recordMetrics(ctx, summary)
+
+	// There is nothing to archive when every stream failed.
+	if err != nil && (failOnPartial || len(summary.FailedStreams) == len(logStreams)) {
+		return false, err
+	}
+
+	if mergeMode && ctx.Err() == nil {
+		check(mergeLogs())
+	}
+
+	return true, err
+}
+
+// fitWriteBuffer returns the size of the buffer of each log file, reduced so that the buffers of all concurrent writers
+// stay within the memory limit. Events are then flushed to the workspace more often, but never below the minimum size.
+func fitWriteBuffer(writers int) int {
+	if maxMemoryBytes == 0 || writers == 0 || int64(writers)*int64(writeBufferBytes) <= maxMemoryBytes {
+		return writeBufferBytes
+	}
+
+	size := int(maxMemoryBytes / int64(writers))
+	if size < minWriteBufferBytes {
+		size = minWriteBufferBytes
+	}
+	logInfo(fmt.Sprintf("Reducing the write buffer to %d bytes to keep %d writers within %d bytes.", size, writers, maxMemoryBytes))
+
+	return size
+}
+
+// checkSingleStream makes sure that the no-tar flag, which produces a single file, is not used with several log streams
+// unless they are merged.
+func checkSingleStream(logStreams []*cloudwatchlogs.LogStream) {
+	if noTar && !mergeMode && len(logStreams) > 1 {
+		panic(fmt.Errorf("the no-tar flag requires a single log stream or the merge mode, %d streams have been found", len(logStreams)))
+	}
+}
+
+// downloadAll downloads all log streams concurrently, and returns the outcome of each stream and the names of the
+// streams which had to be skipped, along with an error joining the error of every one of them.
+func downloadAll(parent context.Context, logStreams []*cloudwatchlogs.LogStream) ([]StreamResult, []string, error) {
+	var failed []string
+	var errs []error
+	var mutex sync.Mutex
+	results := prepareStreamResults(logStreams)
+
+	ctx, cancelFn, err := downloadContext(parent)
+	if err != nil {
+		return failAll(results, err), logStreamNames(logStreams), err
+	}
+	defer cancelFn()
+
+	var wg sync.WaitGroup
+	for name, logStream := range logFileStreams(logStreams) {
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(name string, logStream *cloudwatchlogs.LogStream) {
+			defer wg.Done()
+			err := traceStage(ctx, "download", func(ctx context.Context) error {
+				return downloadLogs(ctx, logStream, name)
+			})
+
+			streamName := aws.StringValue(logStream.LogStreamName)
+			result := results[streamName]
+			result.Truncated = ctx.Err() != nil
+			if err != nil {
+				log.Println(fmt.Sprintf("Skipping the \"%s\" log stream, %v", streamName, err))
+				result.Error = err.Error()
+
+				mutex.Lock()
+				failed = append(failed, streamName)
+				errs = append(errs, fmt.Errorf("failed to download the \"%s\" log stream, %w", streamName, err))
+				mutex.Unlock()
+			}
+		}(name, logStream)
+	}
+	wg.Wait()
+
+	if truncated = ctx.Err() != nil && parent.Err() == nil; truncated {
+		log.Println("The deadline is approaching, downloads have been stopped to archive the logs downloaded so far.")
+	}
+
+	// Goroutines end in any order, failures are sorted to get a stable summary and error.
+	sort.Strings(failed)
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return collectStreamResults(results), failed, errors.Join(errs...)
+}
+
+// prepareStreamResults creates the result and the counters of each log stream before any download, streams which are
+// never downloaded because of the deadline being reported as truncated.
+func prepareStreamResults(logStreams []*cloudwatchlogs.LogStream) map[string]*StreamResult {
+	results := make(map[string]*StreamResult, len(logStreams))
+	streamStats = make(map[string]*progress, len(logStreams))
+	for _, logStream := range logStreams {
+		name := aws.StringValue(logStream.LogStreamName)
+		results[name] = &StreamResult{Name: name, Truncated: true}
+		streamStats[name] = new(progress)
+	}
+
+	return results
+}
+
+// failAll marks every log stream as failed with the same error, when none of them can be downloaded. The streams are
+// then all reported as failed, so that no empty archive is uploaded in place of a previous one.
+func failAll(results map[string]*StreamResult, err error) []StreamResult {
+	for _, result := range results {
+		result.Error = err.Error()
+	}
+
+	return collectStreamResults(results)
+}
+
+// logStreamNames returns the sorted names of the log streams.
+func logStreamNames(logStreams []*cloudwatchlogs.LogStream) []string {
+	names := make([]string, 0, len(logStreams))
+	for _, logStream := range logStreams {
+		names = append(names, aws.StringValue(logStream.LogStreamName))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// collectStreamResults completes the results with the counters of each log stream, sorted by stream name.
+func collectStreamResults(results map[string]*StreamResult) []StreamResult {
+	collected := make([]StreamResult, 0, len(results))
+	for name, result := range results {
+		result.Events = atomic.LoadInt64(&streamStats[name].events)
+		result.Bytes = atomic.LoadInt64(&streamStats[name].bytes)
+		collected = append(collected, *result)
+	}
+
+	sort.Slice(collected, func(i, j int) bool {
+		return collected[i].Name < collected[j].Name
+	})
+
+	return collected
+}
+
+// streamCounters returns the counters of a log stream, which are not kept for streams outside of a download.
+func streamCounters(name string) *progress {
+	if counters, ok := streamStats[name]; ok {
+		return counters
+	}
+
+	return new(progress)
+}
+
+// settleStreams waits until no event has been ingested into the streams for the settle duration, so that events still
+// arriving (e.g. when archiving the current day) are less likely to be missed.
+func settleStreams(ctx context.Context, logStreams []*cloudwatchlogs.LogStream) {
+	if settleWait <= 0 {
+		return
+	}
+
+	var latest int64
+	for _, logStream := range logStreams {
+		if ingestion := aws.Int64Value(logStream.LastIngestionTime); ingestion > latest {
+			latest = ingestion
+		}
+	}
+
+	wait := time.Until(fromMillis(latest).Add(settleWait))
+	if wait <= 0 {
+		return
+	}
+
+	logInfo(fmt.Sprintf("Waiting %s for the recent events to settle.", wait.Round(time.Second)))
+	select {
+	case <-ctx.Done():
+	case <-after(wait):
+	}
+}
+
+// downloadContext returns the context of downloads, which ends a safety margin before the deadline of the process so
+// that the logs downloaded so far can still be archived and uploaded. It fails if the margin leaves no time to download.
+func downloadContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || safetyMargin <= 0 {
+		ctx, cancelFn := context.WithCancel(ctx)
+		return ctx, cancelFn, nil
+	}
+
+	if left := time.Until(deadline); left <= safetyMargin {
+		return nil, nil, fmt.Errorf("the safety margin of %s leaves no time to download before the deadline, only %s are left", safetyMargin, left.Round(time.Millisecond))
+	}
+
+	ctx, cancelFn := context.WithDeadline(ctx, deadline.Add(-safetyMargin))
+	return ctx, cancelFn, nil
+}
+
+// progress holds the download counters shared across goroutines.
+type progress struct {
+	streams     int64
+	events      int64
+	bytes       int64
+	encoded     int64
+	dropped     int64
+	redacted    int64
+	nilMessages int64
+}
+
+// redactRule replaces the substrings matching a pattern.
+type redactRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// add atomically adds the counters of another progress, which are subtracted if the sign is negative.
+func (p *progress) add(other progress, sign int64) {
+	atomic.AddInt64(&p.events, sign*other.events)
+	atomic.AddInt64(&p.bytes, sign*other.bytes)
+	atomic.AddInt64(&p.encoded, sign*other.encoded)
+	atomic.AddInt64(&p.dropped, sign*other.dropped)
+	atomic.AddInt64(&p.redacted, sign*other.redacted)
+	atomic.AddInt64(&p.nilMessages, sign*other.nilMessages)
+}
+
+// reportProgress periodically logs the download progress until the returned function is called, which waits for the
+// last log to be written.
+func reportProgress(stats *progress, total int) func() {
+	if progressInterval <= 0 {
+		return func() {}
+	}
+
+	ticks, stopTicks := newTicker(progressInterval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer stopTicks()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticks:
+				logInfo(fmt.Sprintf("Progress: %d/%d streams downloaded, %d events and %d bytes written.",
+					atomic.LoadInt64(&stats.streams), total, atomic.LoadInt64(&stats.events), atomic.LoadInt64(&stats.bytes)))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// estimateStreams fills the summary with the log streams which would be archived and an estimate of their size, without
+// downloading any event. Stored bytes cover the whole retention of a stream, the estimate is therefore an upper bound.
+func estimateStreams(ctx context.Context, summary *RunSummary) error {
+	logStreams, err := selectLogStreams(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, logStream := range logStreams {
+		if !activeDuring(logStream, startDate, endDate) {
+			continue
+		}
+
+		summary.Streams++
+		summary.EstimatedBytes += aws.Int64Value(logStream.StoredBytes)
+		logInfo(fmt.Sprintf("The \"%s\" log stream stores %d bytes.", aws.StringValue(logStream.LogStreamName),
+			aws.Int64Value(logStream.StoredBytes)))
+	}
+
+	logInfo(fmt.Sprintf("%d log streams would be archived, for at most %d bytes.", summary.Streams, summary.EstimatedBytes))
+
+	return nil
+}
+
+// activeDuring checks whether a log stream has events within a time window, the last ingestion time being considered
+// as the last event timestamp is only updated periodically.
+func activeDuring(logStream *cloudwatchlogs.LogStream, start time.Time, end time.Time) bool {
+	if logStream.FirstEventTimestamp == nil {
+		return false
+	}
+
+	last := aws.Int64Value(logStream.LastEventTimestamp)
+	if ingestion := aws.Int64Value(logStream.LastIngestionTime); ingestion > last {
+		last = ingestion
+	}
+
+	return aws.Int64Value(logStream.FirstEventTimestamp) < toMillis(end) && last >= toMillis(start)
+}
+
+// selectLogStreams retrieves the log streams from which logs must be downloaded.
+func selectLogStreams(ctx context.Context) ([]*cloudwatchlogs.LogStream, error) {
+	if len(streamNames) > 0 {
+		return requireLogStreams(namedLogStreams(ctx))
+	}
+
+	described, err := requireLogStreams(describeLogStreams(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var logStreams []*cloudwatchlogs.LogStream
+	inactive := 0
+	for _, logStream := range described {
+		if isAccessStream(aws.StringValue(logStream.LogStreamName)) {
+			continue
+		}
+
+		// Dormant streams are not worth any GetLogEvents call, unless they must be archived as empty files.
+		if skipInactive && !keepEmpty && !activeDuring(logStream, startDate, endDate) {
+			inactive++
+			continue
+		}
+
+		logStreams = append(logStreams, logStream)
+	}
+
+	if inactive > 0 {
+		logInfo(fmt.Sprintf("%d log streams without any event during the archived day have been skipped.", inactive))
+	}
+
+	return logStreams, nil
+}
+
+// isAccessStream checks whether a log stream contains access logs, which are skipped to avoid long-running processes.
+func isAccessStream(name string) bool {
+	return strings.Contains(name, "access")
+}
+
+// requireLogStreams fails when CloudWatch returned no log stream at all and the require-streams flag is enabled, as
+// it's then more likely to be a misconfiguration than a day without any log.
+func requireLogStreams(logStreams []*cloudwatchlogs.LogStream) ([]*cloudwatchlogs.LogStream, error) {
+	if requireStreams && len(logStreams) == 0 {
+		return nil, fmt.Errorf("no log stream has been found in the \"%s\" log group", logGroup)
+	}
+
+	return logStreams, nil
+}
+
+// describeLogStreams retrieves all log streams of the log group, each page being retried on transient failures so
+// that the streams already collected are not lost.
+func describeLogStreams(ctx context.Context) []*cloudwatchlogs.LogStream {
+	var logStreams []*cloudwatchlogs.LogStream
+
+	input := &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName: aws.String(logGroup),
+		Limit:        aws.Int64(int64(describeLimit)),
+	}
+	for {
+		var page *cloudwatchlogs.DescribeLogStreamsOutput
+		err := retry(ctx, func() error {
+			return withAPITimeout(ctx, func(ctx context.Context) (err error) {
+				page, err = logsService.DescribeLogStreams(ctx, input)
+				return err
+			})
+		})
+		check(err)
+
+		// An empty response is handled as a last page without any stream.
+		if page == nil {
+			page = &cloudwatchlogs.DescribeLogStreamsOutput{}
+		}
+
+		logStreams = append(logStreams, page.LogStreams...)
+		if len(aws.StringValue(page.NextToken)) == 0 {
+			return uniqueLogStreams(logStreams)
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// watermarkKey returns the key of the object storing the watermarks of the environment.
+func watermarkKey() string {
+	return archivePrefix() + "watermark.json"
+}
+
+// loadWatermarks reads the timestamp of the last archived event of each log stream from the first bucket, a missing
+// watermark meaning that the whole period must be archived.
+func loadWatermarks(ctx context.Context) {
+	watermarks = make(map[string]int64)
+	pendingWatermarks = make(map[string]int64)
+	watermarkRun = time.Now().UTC()
+	if !watermarkMode {
+		return
+	}
+
+	client, err := s3Client(ctx, buckets[0])
+	check(err)
+
+	object, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(buckets[0]),
+		Key:    aws.String(watermarkKey()),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		logInfo("No watermark found, the whole period will be archived.")
+		return
+	}
+	if err != nil {
+		panic(fmt.Errorf("failed to read the watermark from \"%s\", %v", buckets[0], err))
+	}
+	defer object.Body.Close()
+
+	if err := json.NewDecoder(object.Body).Decode(&watermarks); err != nil {
+		panic(fmt.Errorf("failed to decode the watermark from \"%s\", %v", buckets[0], err))
+	}
+}
+
+// advanceWatermark keeps the timestamp of the last event downloaded from a log stream.
+func advanceWatermark(stream string, events []*cloudwatchlogs.OutputLogEvent) {
+	if !watermarkMode {
+		return
+	}
+
+	watermarkMutex.Lock()
+	defer watermarkMutex.Unlock()
+	for _, event := range events {
+		if event == nil {
+			continue
+		}
+		if timestamp := aws.Int64Value(event.Timestamp); timestamp > pendingWatermarks[stream] {
+			pendingWatermarks[stream] = timestamp
+		}
+	}
+}
+
+// commitWatermark moves the watermark of a log stream forward once it has been entirely downloaded. Failed or
+// interrupted downloads keep the previous watermark, their events being downloaded again by the next run.
+func commitWatermark(ctx context.Context, stream string, err error) {
+	if !watermarkMode {
+		return
+	}
+
+	watermarkMutex.Lock()
+	defer watermarkMutex.Unlock()
+
+	last, ok := pendingWatermarks[stream]
+	delete(pendingWatermarks, stream)
+	if ok && err == nil && ctx.Err() == nil {
+		watermarks[stream] = last
+	}
+}
+
+// saveWatermarks writes the updated watermarks into the first bucket once the archive has been uploaded.
+func saveWatermarks(ctx context.Context) error {
+	if !watermarkMode {
+		return nil
+	}
+
+	content, err := json.Marshal(watermarks)
+	check(err)
+
+	client, err := s3Client(ctx, buckets[0])
+	if err != nil {
+		return fmt.Errorf("failed to resolve the region of \"%s\", %v", buckets[0], err)
+	}
+
+	if err := newObjectsAPI(client).PutObject(ctx, putObjectInput(buckets[0], watermarkKey(), bytes.NewReader(content))); err != nil {
+		return fmt.Errorf("failed to write the watermark to \"%s\", %v", buckets[0], err)
+	}
+
+	return nil
+}
+
+// uniqueLogStreams removes the streams returned several times across pages, which would otherwise be downloaded
+// concurrently into the same file, as well as the streams without any name.
+func uniqueLogStreams(logStreams []*cloudwatchlogs.LogStream) []*cloudwatchlogs.LogStream {
+	seen := make(map[string]bool, len(logStreams))
+	unique := logStreams[:0]
+	for _, logStream := range logStreams {
+		if logStream == nil || len(aws.StringValue(logStream.LogStreamName)) == 0 {
+			log.Println("Skipping a log stream without any name, returned by CloudWatch.")
+			continue
+		}
+
+		name := aws.StringValue(logStream.LogStreamName)
+		if seen[name] {
+			log.Println(fmt.Sprintf("Skipping the \"%s\" log stream, returned several times by CloudWatch.", name))
+			continue
+		}
+
+		seen[name] = true
+		unique = append(unique, logStream)
+	}
+
+	return unique
+}
+
+// namedLogStreams retrieves the log streams explicitly requested, failing if one of them does not exist.
+func namedLogStreams(ctx context.Context) []*cloudwatchlogs.LogStream {
+	logStreams := make([]*cloudwatchlogs.LogStream, 0, len(streamNames))
+	for _, name := range streamNames {
+		found := findLogStream(ctx, name)
+		if found == nil {
+			panic(fmt.Errorf("the \"%s\" log stream does not exist in the \"%s\" log group", name, logGroup))
+		}
+
+		logStreams = append(logStreams, found)
+	}
+
+	return logStreams
+}
+
+// findLogStream looks for a log stream by its exact name, returning nil if it does not exist.
+func findLogStream(ctx context.Context, name string) *cloudwatchlogs.LogStream {
+	input := &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(logGroup),
+		LogStreamNamePrefix: aws.String(name),
+		Limit:               aws.Int64(int64(describeLimit)),
+	}
+	for {
+		var page *cloudwatchlogs.DescribeLogStreamsOutput
+		err := retry(ctx, func() error {
+			return withAPITimeout(ctx, func(ctx context.Context) (err error) {
+				page, err = logsService.DescribeLogStreams(ctx, input)
+				return err
+			})
+		})
+		check(err)
+		if page == nil {
+			return nil
+		}
+
+		for _, logStream := range page.LogStreams {
+			if logStream != nil && aws.StringValue(logStream.LogStreamName) == name {
+				return logStream
+			}
+		}
+
+		if len(aws.StringValue(page.NextToken)) == 0 {
+			return nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// loadFlagValues replaces the flag values with the command line, the other ones being reset to their default value, and
+// checks whether they are valid.
+func loadFlagValues() {
+	resetFlags()
+	if err := flagSet.Parse(os.Args[1:]); err != nil {
+		panic(err)
+	}
+
+	explicit := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	loadConfigFile(explicit)
+	loadValues()
+}
+
+// loadConfig replaces the flag values with the given options, the other ones being reset to their default value, and
+// checks whether they are valid.
+func loadConfig(cfg Config) {
+	resetFlags()
+
+	// The flag set remembers every option set by previous runs, only the given ones are explicit.
+	explicit := make(map[string]bool)
+	for name, value := range cfg {
+		if err := flagSet.Set(name, value); err != nil {
+			panic(fmt.Errorf("invalid value for the \"%s\" option, %v", name, err))
+		}
+		explicit[name] = true
+	}
+
+	loadConfigFile(explicit)
+	loadValues()
+}
+
+// resetFlags resets every flag to its default value, so that the options of a previous run never leak into the next one.
+func resetFlags() {
+	flagSet.VisitAll(func(f *flag.Flag) {
+		check(f.Value.Set(f.DefValue))
+	})
+}
+
+// loadValues checks whether all option values are valid.
+func loadValues() {
+	loadDestination()
+	loadLogGroup()
+	loadDownloadValues()
+	loadArchiveValues()
+	loadTarValues()
+	loadFormat()
+	loadCompressionConcurrency()
+	loadLineTerminator()
+	loadProjection()
+	loadDropPatterns()
+	loadRedactRules()
+	loadWatermark()
+	loadChunks()
+	loadUploadValues()
+	loadMinArchiveValues()
+	loadDescribeLimit()
+	loadRetryValues()
+	loadWebhook()
+	loadTelemetry()
+	loadGroupTree()
+	loadListStreams()
+	loadDateRange()
+	loadHourWindow()
+	loadDateFormat()
+	loadNameSuffix()
+	checkMinimumAge()
+}
+
+// loadConfigFile applies the values of the configuration file to the options which are neither provided as flags nor as
+// environment variables, the keys of the file being the flag names.
+func loadConfigFile(explicit map[string]bool) {
+	if len(configFile) == 0 {
+		return
+	}
+
+	content, err := os.ReadFile(configFile)
+	check(err)
+
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		panic(fmt.Errorf("failed to parse the configuration file \"%s\", %v", configFile, err))
+	}
+
+	for name, value := range values {
+		key, ok := flagEnvironment[name]
+		if !ok {
+			panic(fmt.Errorf("unknown key \"%s\" in the configuration file \"%s\"", name, configFile))
+		}
+
+		if explicit[name] || len(os.Getenv(key)) > 0 {
+			continue
+		}
+
+		if err := flagSet.Set(name, configValue(value)); err != nil {
+			panic(fmt.Errorf("invalid value for \"%s\" in the configuration file \"%s\", %v", name, configFile, err))
+		}
+	}
+}
+
+// configValue converts a value of the configuration file into a flag value, lists being comma-separated.
+func configValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+
+	return fmt.Sprint(value)
+}
+
+// loadDestination checks whether the buckets and the upload options are valid.
+func loadDestination() {
+	if len(presignedURL) > 0 {
+		loadPresignedURL()
+		return
+	}
+
+	metadataValues = parseMetadata(metadataList)
+
+	buckets = splitList(bucket)
+	if len(buckets) == 0 {
+		panic(errors.New("a valid S3 bucket must be provided"))
+	}
+
+	if destinationType == "gcs" {
+		loadGCSDestination()
+		return
+	}
+	if destinationType != "s3" {
+		panic(errors.New("a valid destination must be provided (s3, gcs)"))
+	}
+
+	for _, destination := range buckets {
+		_, err := parseAccessPoint(destination)
+		check(err)
+		check(checkDirectoryBucket(destination))
+	}
+
+	if streamUpload && len(buckets) > 1 {
+		panic(errors.New("the stream-upload flag only supports a single S3 bucket"))
+	}
+
+	loadObjectOptions()
+}
+
+// loadObjectOptions checks whether the ACL and the storage class of the uploaded objects are supported by S3.
+func loadObjectOptions() {
+	if len(objectACL) > 0 && !contains(s3.ObjectCannedACL_Values(), objectACL) {
+		panic(fmt.Errorf("a valid ACL must be provided (%s)", strings.Join(s3.ObjectCannedACL_Values(), ", ")))
+	}
+
+	if len(storageClass) > 0 && !contains(s3.StorageClass_Values(), storageClass) {
+		panic(fmt.Errorf("a valid storage class must be provided (%s)", strings.Join(s3.StorageClass_Values(), ", ")))
+	}
+}
+
+// checkDirectoryBucket checks whether a directory bucket name is valid, and whether the binary can upload into it.
+func checkDirectoryBucket(destination string) error {
+	if !isDirectoryBucket(destination) {
+		return nil
+	}
+
+	if !directoryBucketPattern.MatchString(destination) {
+		return fmt.Errorf("\"%s\" is not a valid directory bucket name (bucket-base-name--zone-id--x-s3)", destination)
+	}
+	if !supportsDirectoryBuckets {
+		return fmt.Errorf("the \"%s\" directory bucket requires a binary built with the sdkv2 tag", destination)
+	}
+
+	return checkDirectoryOptions()
+}
+
+// checkDirectoryOptions checks whether the upload options are supported with directory buckets.
+func checkDirectoryOptions() error {
+	if listMode || streamUpload || verifyUpload || !overwrite || watermarkMode || len(objectACL) > 0 {
+		return errors.New("directory buckets cannot be used with the list, stream-upload, verify-upload, overwrite, watermark or acl flags")
+	}
+	if len(storageClass) > 0 && storageClass != s3.StorageClassExpressOnezone {
+		return fmt.Errorf("directory buckets only support the %s storage class", s3.StorageClassExpressOnezone)
+	}
+
+	return nil
+}
+
+// isDirectoryBucket checks whether a destination is an S3 directory bucket, based on the suffix of its name.
+func isDirectoryBucket(destination string) bool {
+	return strings.HasSuffix(destination, "--x-s3")
+}
+
+// loadGCSDestination checks whether the binary supports the GCS destination, and whether it's used without any option
+// specific to S3.
+func loadGCSDestination() {
+	if !supportsGCS {
+		panic(errors.New("the gcs destination requires a binary built with the gcs tag"))
+	}
+	if listMode || streamUpload || verifyUpload || writeChecksumFile || !overwrite || len(objectACL) > 0 || len(storageClass) > 0 || len(expectedBucketOwner) > 0 {
+		panic(errors.New("the gcs destination cannot be used with the list, stream-upload, verify-upload, write-checksum-file, overwrite, acl, storage-class or expected-bucket-owner flags"))
+	}
+}
+
+// loadPresignedURL checks whether the presigned URL is valid, and used without any option requiring bucket access.
+func loadPresignedURL() {
+	if parsed, err := url.Parse(presignedURL); err != nil || !contains([]string{"http", "https"}, parsed.Scheme) {
+		panic(errors.New("a valid presigned URL must be provided"))
+	}
+
+	if len(bucket) > 0 || len(logGroupPrefix) > 0 || listMode || streamUpload || verifyUpload || writeChecksumFile || !overwrite {
+		panic(errors.New("the presigned-url flag cannot be used with the bucket, log-group-prefix, list, stream-upload, verify-upload, write-checksum-file or overwrite flags"))
+	}
+}
+
+// loadDownloadValues checks whether the options controlling how logs are downloaded and written are valid.
+func loadDownloadValues() {
+	streamNames = splitList(streamNameList)
+
+	if streamParallelism < 1 {
+		panic(errors.New("a valid stream parallelism must be provided (at least 1)"))
+	}
+
+	if minRetentionDays < 0 {
+		panic(errors.New("a valid minimum retention must be provided (0 to disable the check)"))
+	}
+
+	if writeBufferBytes < minWriteBufferBytes {
+		panic(fmt.Errorf("a valid write buffer size must be provided (at least %d bytes)", minWriteBufferBytes))
+	}
+
+	loadInsightsValues()
+
+	if mergeMode && fromTail {
+		panic(errors.New("the merge and from-tail flags cannot be used together"))
+	}
+
+	if includeIngestionTime && !includeTimestamps {
+		logInfo("The include-ingestion-time flag is ignored as timestamps are not included.")
+	}
+}
+
+// loadInsightsValues checks whether the format and the limit of the Insights query are valid.
+func loadInsightsValues() {
+	if !contains([]string{"json", "csv"}, insightsFormat) {
+		panic(errors.New("a valid Insights format must be provided (json or csv)"))
+	}
+
+	if insightsLimit < 1 || insightsLimit > maxInsightsLimit {
+		panic(fmt.Errorf("a valid Insights limit must be provided (between 1 and %d)", maxInsightsLimit))
+	}
+}
+
+// loadWatermark checks whether the incremental mode is used with a destination able to store the watermark.
+func loadWatermark() {
+	if watermarkMode && (len(presignedURL) > 0 || destinationType == "gcs" || len(insightsQuery) > 0) {
+		panic(errors.New("the watermark flag cannot be used with the presigned-url, destination gcs or insights-query flags"))
+	}
+}
+
+// loadChunks checks whether the chunked mode can be used with the other archive options.
+func loadChunks() {
+	if !chunked {
+		return
+	}
+
+	if chunkCount < 1 {
+		panic(errors.New("a valid number of chunks must be provided (at least 1)"))
+	}
+	if chunkWorkers < 1 {
+		panic(errors.New("a valid number of chunk workers must be provided (at least 1)"))
+	}
+
+	if noTar || streamUpload || len(presignedURL) > 0 {
+		panic(errors.New("the chunked flag cannot be used with the no-tar, stream-upload or presigned-url flags"))
+	}
+}
+
+// loadGroupTree checks whether the log groups can be archived as a tree with the other options.
+func loadGroupTree() {
+	if !groupTree {
+		return
+	}
+
+	if len(logGroupPrefix) == 0 {
+		panic(errors.New("the group-tree flag requires the log-group-prefix flag"))
+	}
+
+	if mergeMode || noTar || listMode || dryRun || selfCheck || watermarkMode || len(insightsQuery) > 0 {
+		panic(errors.New("the group-tree flag cannot be used with the merge, no-tar, list, dry-run, selfcheck, watermark or insights-query flags"))
+	}
+}
+
+// loadListStreams checks whether the log streams can be listed with the other options.
+func loadListStreams() {
+	if listStreamsMode && (listMode || groupTree) {
+		panic(errors.New("the list-streams flag cannot be used with the list or group-tree flags"))
+	}
+}
+
+// loadWebhook checks whether the webhook URL is valid, if any.
+func loadWebhook() {
+	if len(webhookURL) == 0 {
+		return
+	}
+
+	if parsed, err := url.Parse(webhookURL); err != nil || !contains([]string{"http", "https"}, parsed.Scheme) {
+		panic(errors.New("a valid webhook URL must be provided"))
+	}
+
+	if webhookDelay < 0 {
+		panic(errors.New("a valid webhook retry delay must be provided (0 to retry immediately)"))
+	}
+}
+
+// loadTelemetry checks whether the binary supports OpenTelemetry when an endpoint is defined.
+func loadTelemetry() {
+	if len(otelEndpoint) > 0 && !supportsTelemetry {
+		panic(errors.New("the otel-endpoint flag requires a binary built with the otel tag"))
+	}
+}
+
+// loadDescribeLimit checks whether the page size of the log streams is valid, values beyond the maximum accepted by
+// CloudWatch being capped.
+func loadDescribeLimit() {
+	if describeLimit < 1 {
+		panic(errors.New("a valid describe limit must be provided (at least 1)"))
+	}
+
+	if describeLimit > maxDescribeLimit {
+		logInfo(fmt.Sprintf("The describe limit is capped at %d log streams per page.", maxDescribeLimit))
+		describeLimit = maxDescribeLimit
+	}
+}
+
+// loadUploadValues checks whether the multipart upload options are valid.
+func loadUploadValues() {
+	if uploadPartSize < s3manager.MinUploadPartSize {
+		panic(fmt.Errorf("a valid upload part size must be provided (at least %d bytes)", s3manager.MinUploadPartSize))
+	}
+
+	if uploadConcurrency < 1 {
+		panic(errors.New("a valid upload concurrency must be provided (at least 1)"))
+	}
+
+	if maxMemoryBytes < 0 {
+		panic(errors.New("a valid memory limit must be provided (0 for no limit)"))
+	}
+}
+
+// loadMinArchiveValues checks whether the minimum archive size can be checked with the other options.
+func loadMinArchiveValues() {
+	if minArchiveBytes < 0 {
+		panic(errors.New("a valid minimum archive size must be provided (0 for no minimum)"))
+	}
+
+	if !contains([]string{"before", "after"}, minArchiveCheck) {
+		panic(errors.New("a valid minimum archive check must be provided (before or after)"))
+	}
+
+	if minArchiveBytes > 0 && (chunked || streamUpload) {
+		panic(errors.New("the min-archive-bytes flag cannot be used with the chunked or stream-upload flags"))
+	}
+}
+
+// loadRetryValues checks whether the retry policy and the HTTP timeouts are valid, and parses the additional retriable
+// error codes.
+func loadRetryValues() {
+	retriableCodes = splitList(retriableCodeList)
+
+	if maxRetries < 0 {
+		panic(errors.New("a valid number of retries must be provided (0 to disable retries)"))
+	}
+
+	if retryBaseDelay <= 0 || retryMaxDelay < retryBaseDelay {
+		panic(errors.New("valid retry delays must be provided (0 < retry-base-delay <= retry-max-delay)"))
+	}
+
+	if dialTimeout < 0 || tlsTimeout < 0 || httpTimeout < 0 {
+		panic(errors.New("valid HTTP timeouts must be provided (0 to keep the default)"))
+	}
+}
+
+// loadArchiveValues checks whether the archive options can be used together.
+func loadArchiveValues() {
+	if keepWorkspace && cleanWorkspace {
+		panic(errors.New("the keep-workspace and clean flags cannot be used together"))
+	}
+
+	if perFileGzip && mergeMode {
+		panic(errors.New("the per-file-gzip and merge flags cannot be used together"))
+	}
+
+	if includeReadme && noTar {
+		panic(errors.New("the include-readme and no-tar flags cannot be used together"))
+	}
+
+	if !contains([]string{"flat", "hive"}, partitionStyle) {
+		panic(errors.New("a valid partition style must be provided (flat or hive)"))
+	}
+
+	if maxTotalBytes < 0 {
+		panic(errors.New("a valid maximum archive size must be provided (0 for no limit)"))
+	}
+}
+
+// loadTarValues checks whether the options of the tarball entries are valid.
+func loadTarValues() {
+	if tarUID < 0 || tarGID < 0 {
+		panic(errors.New("a valid tar ownership must be provided (non-negative IDs)"))
+	}
+
+	if contains(strings.Split(tarPrefix, "/"), "..") {
+		panic(errors.New("a valid tar prefix must be provided (without \"..\" elements)"))
+	}
+}
+
+// loadFormat checks whether the archive format is supported and compatible with the other compression options.
+func loadFormat() {
+	if noCompression {
+		archiveFormat = "none"
+	}
+
+	if _, ok := formatExtensions[archiveFormat]; !ok {
+		panic(errors.New("a valid archive format must be provided (gzip, bzip2, snappy or none)"))
+	}
+
+	if archiveFormat != "gzip" && (parallelGzip || (perFileGzip && noTar)) {
+		panic(errors.New("the parallel-gzip flag, and the per-file-gzip flag with no-tar, require the gzip format"))
+	}
+
+	if !isLatin1(gzipComment) {
+		panic(errors.New("a valid gzip comment must be provided (Latin-1 text without NUL bytes)"))
+	}
+}
+
+// loadCompressionConcurrency checks whether the compression concurrency is valid, and creates the compression slots.
+func loadCompressionConcurrency() {
+	if compressionConcurrency < 1 {
+		panic(errors.New("a valid compression concurrency must be provided (at least 1)"))
+	}
+
+	compressionSlots = make(chan struct{}, compressionConcurrency)
+}
+
+// loadLineTerminator resolves the line terminator from its name or its escaped sequence.
+func loadLineTerminator() {
+	switch terminatorName {
+	case "lf":
+		lineTerminator = "\n"
+	case "crlf":
+		lineTerminator = "\r\n"
+	default:
+		terminator, err := strconv.Unquote(`"` + terminatorName + `"`)
+		if err != nil || len(terminator) == 0 {
+			panic(fmt.Errorf("a valid line terminator must be provided (lf, crlf or an escaped sequence), got \"%s\"", terminatorName))
+		}
+		lineTerminator = terminator
+	}
+}
+
+// loadProjection compiles the jq expression applied to JSON messages, if any.
+func loadProjection() {
+	projection = nil
+	if len(projectionQuery) == 0 {
+		return
+	}
+
+	query, err := gojq.Parse(projectionQuery)
+	if err == nil {
+		projection, err = gojq.Compile(query)
+	}
+	if err != nil {
+		panic(fmt.Errorf("a valid jq expression must be provided, %v", err))
+	}
+}
+
+// loadDropPatterns compiles the regular expressions of the messages which must not be archived.
+func loadDropPatterns() {
+	dropRegexps = nil
+	for _, pattern := range splitList(dropPatterns) {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			panic(fmt.Errorf("a valid drop pattern must be provided, %v", err))
+		}
+		dropRegexps = append(dropRegexps, compiled)
+	}
+}
+
+// loadRedactRules compiles the redaction rules, the replacement following the last "=" of each rule.
+func loadRedactRules() {
+	redactRules = nil
+	for _, rule := range splitList(redactList) {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			panic(fmt.Errorf("a valid redaction rule must be provided (regex=replacement), got \"%s\"", rule))
+		}
+
+		compiled, err := regexp.Compile(rule[:i])
+		if err != nil {
+			panic(fmt.Errorf("a valid redaction pattern must be provided, %v", err))
+		}
+		redactRules = append(redactRules, redactRule{pattern: compiled, replacement: rule[i+1:]})
+	}
+}
+
+// loadLogGroup checks whether the log group is provided through an environment or discovered with a prefix.
+func loadLogGroup() {
+	if len(logGroupPrefix) > 0 {
+		if len(environment) > 0 {
+			panic(errors.New("the environment and log-group-prefix flags cannot be used together"))
+		}
+		return
+	}
+
+	if len(environment) == 0 {
+		panic(errors.New("a valid environment must be provided"))
+	}
+
+	if logGroup = strings.Replace(template, "{env}", environment, -1); len(logGroup) == 0 {
+		panic(errors.New("a valid log group template must be provided"))
+	}
+}
+
+// loadDateRange computes the time window of the logs that must be archived, the end date being exclusive.
+func loadDateRange() {
+	if today && len(target) > 0 {
+		panic(errors.New("the today and target flags cannot be used together"))
+	}
+
+	if today {
+		now := time.Now().UTC()
+		startDate = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		endDate = now
+		return
+	}
+
+	if len(target) > 0 {
+		r, _ := regexp.Compile(`\d{4}-\d{2}-\d{2}`)
+		if r.MatchString(target) != true {
+			panic(errors.New("a valid target date must be provided (YYYY-MM-DD)"))
+		}
+
+		startDate, _ = time.Parse("2006-01-02", target)
+	} else {
+		yesterday := referenceTime().AddDate(0, 0, -1)
+		startDate = time.Date(yesterday.Year(), yesterday.Month(), yesterday.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	// CloudWatch excludes events whose timestamp is equal to the end time, the window is therefore [start, start+24h).
+	endDate = startDate.Add(24 * time.Hour)
+}
+
+// referenceTime returns the scheduled time of the invocation when the event provides one, so that a delayed or retried
+// invocation still archives the day before its schedule, and the current time otherwise.
+func referenceTime() time.Time {
+	if scheduledTime.IsZero() {
+		return time.Now()
+	}
+
+	return scheduledTime.UTC()
+}
+
+// loadHourWindow narrows the archived period to a range of hours within the archived day.
+func loadHourWindow() {
+	if startHour < 0 || endHour > 24 || startHour >= endHour {
+		panic(errors.New("a valid hour window must be provided (0 <= start-hour < end-hour <= 24)"))
+	}
+
+	day := startDate
+	startDate = day.Add(time.Duration(startHour) * time.Hour)
+	if end := day.Add(time.Duration(endHour) * time.Hour); end.Before(endDate) {
+		endDate = end
+	}
+
+	if !startDate.Before(endDate) {
+		panic(fmt.Errorf("the hour window starting at %s has not started yet", startDate.Format(time.RFC3339)))
+	}
+}
+
+// isHourWindow checks whether only a range of hours of the archived day is archived.
+func isHourWindow() bool {
+	return startHour > 0 || endHour < 24
+}
+
+// loadDateFormat resolves the date-format presets and checks whether the layout renders a day, and only a day.
+func loadDateFormat() {
+	if layout, ok := dateFormatPresets[dateFormat]; ok {
+		dateFormat = layout
+	}
+
+	// A layout rendering times would produce different names for the same day, and a layout missing the year, the month
+	// or the day would produce the same name for different days.
+	reference := time.Date(2001, time.February, 3, 0, 0, 0, 0, time.UTC)
+	rendered := reference.Format(dateFormat)
+	if reference.Add(23*time.Hour+59*time.Minute+59*time.Second).Format(dateFormat) != rendered {
+		panic(fmt.Errorf("the date format \"%s\" must not depend on the time of day", dateFormat))
+	}
+
+	if parsed, err := time.Parse(dateFormat, rendered); err != nil || !parsed.Equal(reference) {
+		panic(fmt.Errorf("the date format \"%s\" must render the year, the month and the day", dateFormat))
+	}
+}
+
+// loadNameSuffix checks whether the name suffix only contains characters which are safe in object keys.
+func loadNameSuffix() {
+	if len(nameSuffix) > 0 && !nameSuffixPattern.MatchString(nameSuffix) {
+		panic(errors.New("a valid name suffix must be provided (letters, digits, dots, dashes and underscores)"))
+	}
+}
+
+// logInfo logs an informational message, unless the quiet mode is enabled.
+func logInfo(message string) {
+	if !quiet {
+		log.Println(message)
+	}
+}
+
+// checkMinimumAge refuses to archive a day which is not over for long enough, as late events could still be missing.
+// The today flag is not concerned since it explicitly produces a partial archive.
+func checkMinimumAge() {
+	if today || force {
+		return
+	}
+
+	minimumAge := time.Duration(minAgeHours) * time.Hour
+	if age := time.Since(endDate); age < minimumAge {
+		panic(fmt.Errorf("refusing to archive logs ending on %s, which is less than %d hours ago (use -force to override)",
+			endDate.Format(time.RFC3339), minAgeHours))
+	}
+}
+
+// getEnv retrieves a value from an environment variable, the fallback being used when it's unset.
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return fallback
+}
+
+// getEnvBool retrieves a boolean value from an environment variable, false being used when it's unset or invalid.
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// getEnvInt retrieves an integer value from an environment variable, the fallback being used when it's unset or invalid.
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// splitList splits a comma-separated list, ignoring blank items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// getEnvDuration retrieves a duration from an environment variable, zero being used when it's unset or invalid.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// contains checks whether a value is part of a list.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// archiveKey returns the S3 key under which the archive is uploaded.
+func archiveKey(name string) string {
+	if partitionStyle == "hive" {
+		return archivePrefix() + startDate.Format("year=2006/month=01/day=02/") + name
+	}
+
+	return archivePrefix() + name
+}
+
+// archivePrefix returns the S3 prefix under which all archives of the environment are uploaded.
+func archivePrefix() string {
+	return "/" + environment + "/"
+}
+
+// archiveName returns the name of the archive, partial archives of the current day being marked as such.
+// Incremental archives also contain the time of the run, so that successive runs over the same day do not collide.
+func archiveName() string {
+	if noTar {
+		return archiveBaseName() + ".log" + formatExtensions[archiveFormat]
+	}
+
+	return archiveBaseName() + ".tar" + formatExtensions[archiveFormat]
+}
+
+// archiveBaseName returns the name of the archive without its extension.
+func archiveBaseName() string {
+	name := startDate.Format(dateFormat)
+	if isHourWindow() {
+		name += fmt.Sprintf("-%02dh-%02dh", startHour, endHour)
+	}
+	if watermarkMode {
+		name += "-" + watermarkRun.Format("150405")
+	}
+	if len(nameSuffix) > 0 {
+		name += "." + nameSuffix
+	}
+	if today || truncated {
+		name += ".partial"
+	}
+
+	return name
+}
+
+// serviceOptions are the options from which the AWS session and the service clients are created, retry options being
+// part of the S3 clients and of the clients of the second version of the SDK.
+type serviceOptions struct {
+	profile        string
+	region         string
+	dialTimeout    time.Duration
+	tlsTimeout     time.Duration
+	httpTimeout    time.Duration
+	otelEndpoint   string
+	gcs            bool
+	maxRetries     int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	retriableCodes string
+}
+
+// currentServiceOptions returns the service options of the current run.
+func currentServiceOptions() serviceOptions {
+	return serviceOptions{
+		profile:        profile,
+		region:         region,
+		dialTimeout:    dialTimeout,
+		tlsTimeout:     tlsTimeout,
+		httpTimeout:    httpTimeout,
+		otelEndpoint:   otelEndpoint,
+		gcs:            destinationType == "gcs",
+		maxRetries:     maxRetries,
+		retryBaseDelay: retryBaseDelay,
+		retryMaxDelay:  retryMaxDelay,
+		retriableCodes: strings.Join(retriableCodes, ","),
+	}
+}
+
+// loadServices creates the service clients unless those of a previous run have been created with the same options, so
+// that they are reused across warm invocations while a call with another region or profile gets its own clients.
+func loadServices() {
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+
+	options := currentServiceOptions()
+	if servicesOptions != nil && options == *servicesOptions {
+		return
+	}
+
+	// The clients are created again by the next run if their creation panics halfway.
+	servicesOptions = nil
+	initServices()
+	servicesOptions = &options
+}
+
+// initServices creates the AWS session and the service clients.
+func initServices() {
+	awsHTTPClient = httpClient()
+	awsSession = session.Must(session.NewSessionWithOptions(sessionOptions()))
+	cwService = cloudwatchlogs.New(awsSession)
+	s3Service = s3.New(awsSession, s3Config())
+	logsService = newLogsAPI()
+
+	traceClient(cwService.Client)
+	traceClient(s3Service.Client)
+
+	initGCSClient()
+	initTelemetry()
+}
+
+// resetServices discards the service clients, so that they are created again with the current options by the next run.
+func resetServices() {
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+
+	servicesOptions = nil
+}
+
+// traceStage runs a stage of the process in an X-Ray subsegment when tracing is enabled, and in an OpenTelemetry span
+// when an endpoint is defined.
+func traceStage(ctx context.Context, name string, fn func(context.Context) error) error {
+	run := fn
+	if tracingEnabled() {
+		run = func(ctx context.Context) error {
+			return captureSubsegment(ctx, name, fn)
+		}
+	}
+
+	return traceSpan(ctx, name, run)
+}
+
+// sessionOptions returns the options of the AWS session, the default credential chain being used unless a profile or a
+// region is explicitly provided.
+func sessionOptions() session.Options {
+	options := session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+
+	// CloudWatch calls are retried by the process itself, the SDK must not retry them again. S3 clients have their own
+	// retryer (see s3Config).
+	options.Config.MaxRetries = aws.Int(0)
+
+	if len(region) > 0 {
+		options.Config.Region = aws.String(region)
+	}
+	if awsHTTPClient != nil {
+		options.Config.HTTPClient = awsHTTPClient
+	}
+
+	return options
+}
+
+// httpClient returns the HTTP client of the AWS services with the configured timeouts, nil keeping the default client
+// of the SDK when no timeout is configured.
+func httpClient() *http.Client {
+	if awsTransport == nil && dialTimeout == 0 && tlsTimeout == 0 && httpTimeout == 0 {
+		return nil
+	}
+	if awsTransport != nil {
+		return &http.Client{Transport: awsTransport, Timeout: httpTimeout}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if tlsTimeout > 0 {
+		transport.TLSHandshakeTimeout = tlsTimeout
+	}
+
+	return &http.Client{Transport: transport, Timeout: httpTimeout}
+}
+
+// check causes the current program to exit if an error occurred.
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// releaseWorkspace removes the workspace at the end of the run if required, otherwise it is kept until the next run.
+func releaseWorkspace() {
+	switch {
+	case cleanWorkspace:
+		check(os.RemoveAll(workspace))
+		logInfo(fmt.Sprintf("The \"%s\" workspace has been removed.", workspace))
+	case keepWorkspace:
+		logInfo(fmt.Sprintf("The \"%s\" workspace has been kept for debugging.", workspace))
+	default:
+		logInfo(fmt.Sprintf("The \"%s\" workspace will be removed at the beginning of the next run.", workspace))
+	}
+}
+
+// prepareWorkspace deletes and creates the directory where CloudWatch logs will be processed.
+func prepareWorkspace() {
+	// Files may remain from a previous run which crashed or which was executed in the same warm environment.
+	if leftovers, err := os.ReadDir(workspace); err == nil && len(leftovers) > 0 {
+		logInfo(fmt.Sprintf("Removing %d stale files from the workspace.", len(leftovers)))
+	}
+
+	err := os.RemoveAll(workspace)
+	check(err)
+
+	err = os.MkdirAll(workspace, 0700)
+	check(err)
+}
+
+// prepareGroupDirectory prepares the workspace directory of the current log group, the whole workspace being recreated
+// unless the log group is part of a tree.
+func prepareGroupDirectory() {
+	if len(groupDirectory) == 0 {
+		prepareWorkspace()
+		return
+	}
+
+	check(os.MkdirAll(workspace+string(os.PathSeparator)+groupDirectory, 0700))
+}
+
+// lockWorkspace creates the lock file of the workspace, failing if another process already holds it.
+func lockWorkspace(ctx context.Context) error {
+	if staleLock() {
+		logInfo("Removing a stale workspace lock.")
+		if err := os.Remove(workspaceLock); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	var expiry int64
+	if deadline, ok := ctx.Deadline(); ok {
+		expiry = deadline.Unix()
+	}
+
+	// The lock is written aside then linked, so that other processes never read an incomplete lock.
+	pending := fmt.Sprintf("%s.%d", workspaceLock, os.Getpid())
+	if err := os.WriteFile(pending, []byte(fmt.Sprintf("%d %d\n", os.Getpid(), expiry)), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(pending)
+
+	err := os.Link(pending, workspaceLock)
+	if os.IsExist(err) {
+		return errors.New("the workspace is already used by another archiving process")
+	}
+
+	return err
+}
+
+// staleLock checks whether the workspace lock has been left by a process which no longer runs or whose run is past its
+// deadline. A lock owned by the current process is also stale, as its runs are serialized and release the lock.
+func staleLock() bool {
+	content, err := os.ReadFile(workspaceLock)
+	if err != nil {
+		return false
+	}
+
+	var pid int
+	var deadline int64
+	if _, err := fmt.Sscan(string(content), &pid, &deadline); err != nil || pid <= 0 {
+		return true
+	}
+	if deadline > 0 && time.Now().Unix() > deadline {
+		return true
+	}
+
+	return pid == os.Getpid() || !processRuns(pid)
+}
+
+// processRuns checks whether a process runs, a process of another user being reported as running.
+func processRuns(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// unlockWorkspace removes the lock file of the workspace.
+func unlockWorkspace() {
+	if err := os.Remove(workspaceLock); err != nil {
+		log.Println(fmt.Sprintf("Unable to remove the workspace lock, %v", err))
+	}
+}
+
+// timeWindow represents a portion of the archived day, the end being exclusive.
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// logFileNames computes the workspace file name of each log stream and returns the stream name of each file.
+// Stream names are sanitized, colliding names being disambiguated with a short hash of the original name.
+func logFileNames(logStreams []*cloudwatchlogs.LogStream) map[string]string {
+	occurrences := make(map[string]int)
+	for _, logStream := range logStreams {
+		occurrences[sanitizeName(aws.StringValue(logStream.LogStreamName))]++
+	}
+
+	files := make(map[string]string)
+	for _, logStream := range logStreams {
+		name := sanitizeName(aws.StringValue(logStream.LogStreamName))
+		if occurrences[name] > 1 {
+			hash := sha256.Sum256([]byte(aws.StringValue(logStream.LogStreamName)))
+			name += "-" + hex.EncodeToString(hash[:4])
+		}
+
+		files[name+".log"] = aws.StringValue(logStream.LogStreamName)
+	}
+
+	return files
+}
+
+// logFileStreams returns the log stream which must be downloaded into each workspace file.
+func logFileStreams(logStreams []*cloudwatchlogs.LogStream) map[string]*cloudwatchlogs.LogStream {
+	byName := make(map[string]*cloudwatchlogs.LogStream)
+	for _, logStream := range logStreams {
+		byName[aws.StringValue(logStream.LogStreamName)] = logStream
+	}
+
+	files := make(map[string]*cloudwatchlogs.LogStream)
+	for file, name := range streamFiles {
+		files[file] = byName[name]
+	}
+
+	return files
+}
+
+// groupKeyPrefix returns the key prefix of the archives of a discovered log group, so that every group gets its own
+// prefix without nesting the path of its name (e.g. "/aws/lambda/api" is archived under "aws_lambda_api").
+func groupKeyPrefix(group string) string {
+	return sanitizeName(strings.TrimLeft(group, "/"))
+}
+
+// sanitizeName replaces path separators, which are common in log stream names, to get a valid file name.
+func sanitizeName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+}
+
+// downloadLogs downloads CloudWatch logs into the given workspace file. An error is returned when CloudWatch fails to
+// read the stream, which can then be skipped without failing the whole process.
+func downloadLogs(ctx context.Context, logStream *cloudwatchlogs.LogStream, name string) error {
+	if mergeMode {
+		name += mergeSuffix
+	}
+	if perFileGzip {
+		name += ".gz"
+	}
+
+	file, err := os.Create(workspace + string(os.PathSeparator) + groupDirectory + name)
+	if err != nil {
+		return err
+	}
+
+	// Events are compressed while being downloaded, no uncompressed copy of the stream is ever written.
+	var output io.Writer = file
+	var compressor io.WriteCloser
+	if perFileGzip {
+		gw := gzip.NewWriter(file)
+		gw.Header = gzipHeader(strings.TrimSuffix(path.Base(file.Name()), ".gz"))
+		compressor = boundedCompressor{gw: gw}
+		output = compressor
+	}
+
+	counter := &limitedWriter{output: output}
+	err = downloadWindows(ctx, counter, file.Name(), logStream)
+	if compressor != nil {
+		// Closing the writer ends the gzip member, which can then be concatenated with other members.
+		err = errors.Join(err, compressor.Close())
+	}
+
+	// The file is explicitly persisted and closed so that the archive never reads a partially written entry.
+	err = errors.Join(err, file.Sync(), file.Close())
+	commitWatermark(ctx, aws.StringValue(logStream.LogStreamName), err)
+
+	if err != nil {
+		os.Remove(file.Name())
+		warnInvalidParameter(logStream, err)
+		return err
+	}
+
+	// Streams without any event on the archived day are skipped, unless their existence must be proven.
+	if counter.written == 0 && !keepEmpty {
+		if err := os.Remove(file.Name()); err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt64(&stats.streams, 1)
+
+	return nil
+}
+
+// warnInvalidParameter warns when CloudWatch rejects the parameters of a log stream, which happens with very recent
+// streams: only this stream is skipped and reported as failed, the other ones being still archived.
+func warnInvalidParameter(logStream *cloudwatchlogs.LogStream, err error) {
+	if errorCode(err) == cloudwatchlogs.ErrCodeInvalidParameterException {
+		log.Println(fmt.Sprintf("The \"%s\" log stream has been rejected by CloudWatch, it may be too recent to be read.", aws.StringValue(logStream.LogStreamName)))
+	}
+}
+
+// errorCode returns the code of an AWS error of either version of the SDK, or an empty string for other errors.
+func errorCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+
+	return ""
+}
+
+// downloadWindows writes the events of a log stream, fetching the sub-windows of the day concurrently if required.
+func downloadWindows(ctx context.Context, output io.Writer, fileName string, logStream *cloudwatchlogs.LogStream) error {
+	windows := splitWindow(streamWindow(aws.StringValue(logStream.LogStreamName)), streamParallelism)
+	if len(windows) == 1 && splitThreshold > 0 {
+		return fetchOrSplit(ctx, output, fileName, logStream, windows[0])
+	}
+	if len(windows) == 1 {
+		return fetchEvents(ctx, output, logStream, windows[0], 0)
+	}
+
+	// Each sub-window is fetched into its own part file, parts are then concatenated in the archived order.
+	parts, err := createParts(fileName, len(windows))
+	if err != nil {
+		return err
+	}
+	defer removeParts(parts)
+
+	if err := fetchParts(ctx, parts, logStream, windows); err != nil {
+		return err
+	}
+
+	if fromTail {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	for _, part := range parts {
+		if err := copyPart(output, part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchParts fetches the events of each sub-window concurrently into its part file.
+func fetchParts(ctx context.Context, parts []*os.File, logStream *cloudwatchlogs.LogStream, windows []timeWindow) error {
+	errs := make([]error, len(windows))
+	var wg sync.WaitGroup
+	for i, window := range windows {
+		wg.Add(1)
+		go func(i int, part *os.File, window timeWindow) {
+			defer wg.Done()
+			errs[i] = fetchEvents(ctx, part, logStream, window, 0)
+		}(i, parts[i], window)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// createParts creates the part files of the sub-windows of a log stream, removing them all if one cannot be created.
+func createParts(fileName string, count int) ([]*os.File, error) {
+	parts := make([]*os.File, 0, count)
+	for i := 0; i < count; i++ {
+		part, err := os.Create(fmt.Sprintf("%s.part%d", fileName, i))
+		if err != nil {
+			removeParts(parts)
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
+
+// removeParts closes and removes part files, which are only temporary.
+func removeParts(parts []*os.File) {
+	for _, part := range parts {
+		part.Close()
+		os.Remove(part.Name())
+	}
+}
+
+// copyPart copies the whole content of a part file into the output.
+func copyPart(output io.Writer, part *os.File) error {
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(output, part)
+
+	return err
+}
+
+// fetchOrSplit fetches the events of a window into a part file, then copies them into the output. If the window holds
+// more events than the split threshold, the stream is downloaded again hour by hour, directly into the output.
+func fetchOrSplit(ctx context.Context, output io.Writer, fileName string, logStream *cloudwatchlogs.LogStream, window timeWindow) error {
+	part, err := os.Create(fileName + ".part")
+	if err != nil {
+		return err
+	}
+	defer removeParts([]*os.File{part})
+
+	if err := fetchEvents(ctx, part, logStream, window, splitThreshold); err != errTooManyEvents {
+		if err == nil {
+			err = copyPart(output, part)
+		}
+		return err
+	}
+
+	name := aws.StringValue(logStream.LogStreamName)
+	logInfo(fmt.Sprintf("The \"%s\" log stream holds more than %d events, downloading it hour by hour.", name, splitThreshold))
+
+	hours := splitWindow(window, int(math.Ceil(window.end.Sub(window.start).Hours())))
+	if fromTail {
+		for i, j := 0, len(hours)-1; i < j; i, j = i+1, j-1 {
+			hours[i], hours[j] = hours[j], hours[i]
+		}
+	}
+
+	for _, hour := range hours {
+		if err := fetchEvents(ctx, output, logStream, hour, 0); err != nil {
+			return err
+		}
+		logInfo(fmt.Sprintf("The \"%s\" log stream has been downloaded from %s to %s.", name,
+			hour.start.Format(time.RFC3339), hour.end.Format(time.RFC3339)))
+	}
+
+	return nil
+}
+
+// streamWindow returns the time window of a log stream, which starts after its watermark in incremental mode.
+func streamWindow(stream string) timeWindow {
+	window := timeWindow{startDate, endDate}
+
+	watermarkMutex.Lock()
+	last, ok := watermarks[stream]
+	watermarkMutex.Unlock()
+
+	if ok {
+		if start := fromMillis(last + 1); start.After(window.start) {
+			window.start = start
+		}
+		if window.start.After(window.end) {
+			window.start = window.end
+		}
+	}
+
+	return window
+}
+
+// splitWindow splits a time window into consecutive sub-windows of the same duration.
+func splitWindow(window timeWindow, count int) []timeWindow {
+	if count <= 1 {
+		return []timeWindow{window}
+	}
+
+	step := (window.end.Sub(window.start) / time.Duration(count)).Truncate(time.Millisecond)
+	if step <= 0 {
+		return []timeWindow{window}
+	}
+
+	windows := make([]timeWindow, count)
+	for i := range windows {
+		windows[i] = timeWindow{window.start.Add(time.Duration(i) * step), window.start.Add(time.Duration(i+1) * step)}
+	}
+	windows[count-1].end = window.end
+
+	return windows
+}
+
+// fetchEvents writes all events of a log stream which occurred during the time window.
+// Past maxEvents (if not zero), the download stops with errTooManyEvents and nothing is counted.
+func fetchEvents(ctx context.Context, output io.Writer, logStream *cloudwatchlogs.LogStream, window timeWindow, maxEvents int64) error {
+	writer := bufio.NewWriterSize(output, streamBufferBytes)
+	nextToken := ""
+	var total progress
+	counters := streamCounters(aws.StringValue(logStream.LogStreamName))
+	for {
+		logEventInput := &cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  aws.String(logGroup),
+			LogStreamName: logStream.LogStreamName,
+			StartTime:     aws.Int64(toMillis(window.start)),
+			EndTime:       aws.Int64(toMillis(window.end)),
+			StartFromHead: aws.Bool(!fromTail),
+		}
+		if len(nextToken) > 0 {
+			logEventInput.NextToken = aws.String(nextToken)
+		}
+
+		eventList, err := getLogEvents(ctx, logEventInput)
+		if ctx.Err() != nil {
+			// The process has been canceled, the partial file is removed along with the workspace.
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if maxEvents > 0 && total.events+int64(len(eventList.Events)) > maxEvents {
+			stats.add(total, -1)
+			counters.add(total, -1)
+			return errTooManyEvents
+		}
+
+		page := writePage(writer, eventList.Events)
+		advanceWatermark(aws.StringValue(logStream.LogStreamName), eventList.Events)
+		total.add(page, 1)
+		stats.add(page, 1)
+		counters.add(page, 1)
+
+		if nextToken = nextPageToken(eventList); len(eventList.Events) == 0 || len(nextToken) == 0 {
+			break
+		}
+	}
+
+	return writer.Flush()
+}
+
+// getLogEvents fetches a page of events, retrying the calls which failed because of a transient error or a timeout.
+func getLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	var eventList *cloudwatchlogs.GetLogEventsOutput
+	err := retry(ctx, func() error {
+		return withAPITimeout(ctx, func(ctx context.Context) (err error) {
+			eventList, err = logsService.GetLogEvents(ctx, input)
+			return err
+		})
+	})
+
+	// An empty response is handled as a last page without any event.
+	if err == nil && eventList == nil {
+		eventList = &cloudwatchlogs.GetLogEventsOutput{}
+	}
+
+	return eventList, err
+}
+
+// writePage writes the events of a page in the archived order, and returns the corresponding counters.
+func writePage(writer *bufio.Writer, events []*cloudwatchlogs.OutputLogEvent) progress {
+	page := progress{events: int64(len(events))}
+	for _, eventItem := range orderedEvents(events) {
+		if eventItem == nil {
+			page.events--
+			continue
+		}
+
+		// Metadata-only events have no message, there is no line to write for them.
+		if eventItem.Message == nil {
+			page.nilMessages++
+			continue
+		}
+
+		if isDropped(*eventItem.Message) {
+			page.dropped++
+			continue
+		}
+
+		message, keep := projectMessage(redactMessage(*eventItem.Message, &page))
+		if !keep {
+			page.dropped++
+			continue
+		}
+
+		writeEvent(writer, eventItem, formatLine(eventItem, formatMessage(message, &page)), &page)
+	}
+
+	return page
+}
+
+// isDropped checks whether a message matches one of the drop patterns.
+func isDropped(message string) bool {
+	for _, pattern := range dropRegexps {
+		if pattern.MatchString(message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactMessage applies the redaction rules in their configured order, and counts the replaced substrings.
+func redactMessage(message string, counters *progress) string {
+	// Replacements are applied to the whole message, as anchors and word boundaries depend on the surrounding text.
+	for _, rule := range redactRules {
+		if matches := rule.pattern.FindAllStringIndex(message, -1); len(matches) > 0 {
+			counters.redacted += int64(len(matches))
+			message = rule.pattern.ReplaceAllString(message, rule.replacement)
+		}
+	}
+
+	return message
+}
+
+// projectMessage applies the projection to a JSON message, the results being written as compact JSON on the same line.
+// Messages which are not JSON, or which the projection fails on, are kept as is unless they must be dropped.
+func projectMessage(message string) (string, bool) {
+	if projection == nil {
+		return message, true
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(message), &value); err != nil {
+		return message, !dropNonJSON
+	}
+
+	var results []string
+	iter := projection.Run(value)
+	for {
+		result, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if _, failed := result.(error); failed {
+			return message, !dropNonJSON
+		}
+
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return message, !dropNonJSON
+		}
+		results = append(results, string(encoded))
+	}
+
+	return strings.Join(results, " "), true
+}
+
+// writeEvent writes the line of an event, along with its timestamp in merge mode so that streams can be sorted later.
+func writeEvent(writer *bufio.Writer, event *cloudwatchlogs.OutputLogEvent, line string, counters *progress) {
+	// Write errors are kept by the buffered writer, they are returned when it's flushed.
+	if mergeMode {
+		writeMergeRecord(writer, aws.Int64Value(event.Timestamp), line)
+	} else {
+		writer.WriteString(line)
+		writer.WriteString(lineTerminator)
+	}
+
+	counters.bytes += int64(len(line) + len(lineTerminator))
+}
+
+// formatLine prefixes the message with the event timestamp, and its ingestion time if required.
+func formatLine(event *cloudwatchlogs.OutputLogEvent, message string) string {
+	if !includeTimestamps {
+		return message
+	}
+
+	fields := []string{formatMillis(aws.Int64Value(event.Timestamp))}
+	if includeIngestionTime {
+		fields = append(fields, formatMillis(aws.Int64Value(event.IngestionTime)))
+	}
+
+	return strings.Join(append(fields, message), fieldDelimiter)
+}
+
+// formatMillis formats a number of milliseconds since the Unix epoch as an RFC 3339 UTC time.
+func formatMillis(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// formatMessage returns the message as written into the archive, binary messages being base64-encoded if required.
+func formatMessage(message string, counters *progress) string {
+	if !encodeBinary || (utf8.ValidString(message) && !strings.ContainsRune(message, 0)) {
+		return message
+	}
+
+	counters.encoded++
+	return binaryPrefix + base64.StdEncoding.EncodeToString([]byte(message))
+}
+
+// orderedEvents returns the events of a page in the archived order, which is descending when reading from the tail.
+func orderedEvents(events []*cloudwatchlogs.OutputLogEvent) []*cloudwatchlogs.OutputLogEvent {
+	if !fromTail {
+		return events
+	}
+
+	reversed := make([]*cloudwatchlogs.OutputLogEvent, len(events))
+	for i, event := range events {
+		reversed[len(events)-1-i] = event
+	}
+
+	return reversed
+}
+
+// nextPageToken returns the token of the next page, following older events when reading from the tail.
+func nextPageToken(eventList *cloudwatchlogs.GetLogEventsOutput) string {
+	if fromTail {
+		return aws.StringValue(eventList.NextBackwardToken)
+	}
+
+	return aws.StringValue(eventList.NextForwardToken)
+}
+
+// toMillis converts a time into a number of milliseconds since the Unix epoch, as expected by CloudWatch.
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis converts a number of milliseconds since the Unix epoch, as returned by CloudWatch, into a time.
+func fromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// queryInsights runs the CloudWatch Logs Insights query over the log group and writes its results into the workspace.
+func queryInsights(ctx context.Context) (int64, error) {
+	var query *cloudwatchlogs.StartQueryOutput
+	err := retry(ctx, func() error {
+		return withAPITimeout(ctx, func(ctx context.Context) (err error) {
+			query, err = cwService.StartQueryWithContext(ctx, &cloudwatchlogs.StartQueryInput{
+				LogGroupName: aws.String(logGroup),
+				QueryString:  aws.String(insightsQuery),
+				StartTime:    aws.Int64(startDate.Unix()),
+				EndTime:      aws.Int64(endDate.Unix()),
+				Limit:        aws.Int64(int64(insightsLimit)),
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start the Insights query, %v", err)
+	}
+
+	results, err := waitInsightsResults(ctx, query.QueryId)
+	if err != nil {
+		return 0, err
+	}
+	if len(results.Results) >= insightsLimit {
+		log.Println(fmt.Sprintf("The Insights query returned %d results, which is its limit: some results may be missing.", len(results.Results)))
+	}
+
+	file, err := os.Create(workspace + string(os.PathSeparator) + "insights." + insightsFormat)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	rows := insightsRows(results.Results)
+	if insightsFormat == "csv" {
+		err = writeInsightsCSV(file, rows)
+	} else {
+		err = writeInsightsJSON(file, rows)
+	}
+
+	return int64(len(rows)), err
+}
+
+// waitInsightsResults polls the results of an Insights query until it completes. The query is stopped when the process
+// is canceled in the meantime, so that it does not keep running.
+func waitInsightsResults(ctx context.Context, queryID *string) (*cloudwatchlogs.GetQueryResultsOutput, error) {
+	for {
+		var results *cloudwatchlogs.GetQueryResultsOutput
+		err := retry(ctx, func() error {
+			return withAPITimeout(ctx, func(ctx context.Context) (err error) {
+				results, err = cwService.GetQueryResultsWithContext(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: queryID})
+				return err
+			})
+		})
+		if err != nil {
+			stopQuery(queryID)
+			return nil, fmt.Errorf("failed to get the results of the Insights query, %v", err)
+		}
+
+		status := aws.StringValue(results.Status)
+		if status == cloudwatchlogs.QueryStatusComplete {
+			return results, nil
+		}
+		if status != cloudwatchlogs.QueryStatusScheduled && status != cloudwatchlogs.QueryStatusRunning {
+			return nil, fmt.Errorf("insights query ended with the \"%s\" status", status)
+		}
+
+		select {
+		case <-ctx.Done():
+			stopQuery(queryID)
+			return nil, ctx.Err()
+		case <-after(insightsPollInterval):
+		}
+	}
+}
+
+// stopQuery stops an Insights query whose results are no longer awaited. The process may have been canceled, the call
+// therefore has its own deadline.
+func stopQuery(queryID *string) {
+	duration, _ := time.ParseDuration(timeout)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), duration)
+	defer cancelFn()
+
+	if _, err := cwService.StopQueryWithContext(ctx, &cloudwatchlogs.StopQueryInput{QueryId: queryID}); err != nil {
+		log.Println(fmt.Sprintf("Unable to stop the Insights query, %v", err))
+	}
+}
+
+// insightsRow is a result of an Insights query, fields being kept in their original order.
+type insightsRow struct {
+	fields []string
+	values map[string]string
+}
+
+// insightsRows converts the results of an Insights query, the internal "@ptr" field being ignored.
+func insightsRows(results [][]*cloudwatchlogs.ResultField) []insightsRow {
+	rows := make([]insightsRow, 0, len(results))
+	for _, result := range results {
+		row := insightsRow{values: make(map[string]string)}
+		for _, field := range result {
+			name := aws.StringValue(field.Field)
+			if name == "@ptr" {
+				continue
+			}
+
+			row.fields = append(row.fields, name)
+			row.values[name] = aws.StringValue(field.Value)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// writeInsightsJSON writes the rows of an Insights query as JSON lines.
+func writeInsightsJSON(output io.Writer, rows []insightsRow) error {
+	encoder := json.NewEncoder(output)
+	for _, row := range rows {
+		if err := encoder.Encode(row.values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeInsightsCSV writes the rows of an Insights query as CSV, the header containing every field found in the rows.
+func writeInsightsCSV(output io.Writer, rows []insightsRow) error {
+	var header []string
+	for _, row := range rows {
+		for _, field := range row.fields {
+			if !contains(header, field) {
+				header = append(header, field)
+			}
+		}
+	}
+
+	writer := csv.NewWriter(output)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, field := range header {
+			record[i] = row.values[field]
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// mergeRecord is an event read from a stream downloaded in merge mode.
+type mergeRecord struct {
+	timestamp int64
+	line      string
+	source    int
+}
+
+// mergeHeap orders the next record of each stream by timestamp, then by stream to keep the result deterministic.
+type mergeHeap []mergeRecord
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].timestamp != h[j].timestamp {
+		return h[i].timestamp < h[j].timestamp
+	}
+	return h[i].source < h[j].source
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeRecord)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	record := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return record
+}
+
+// writeMergeRecord writes an event with its timestamp, its length allowing messages to contain line breaks.
+func writeMergeRecord(writer io.Writer, timestamp int64, line string) error {
+	if err := binary.Write(writer, binary.BigEndian, timestamp); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(line))); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(writer, line)
+
+	return err
+}
+
+// readMergeRecord reads the next event written by writeMergeRecord, io.EOF being returned at the end of the stream.
+func readMergeRecord(reader io.Reader) (int64, string, error) {
+	var timestamp int64
+	if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+		return 0, "", err
+	}
+
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return 0, "", err
+	}
+
+	line := make([]byte, length)
+	_, err := io.ReadFull(reader, line)
+
+	return timestamp, string(line), err
+}
+
+// mergeLogs merges the events of all downloaded streams into a single file sorted by timestamp, each stream being
+// already sorted. Only the next event of each stream is kept in memory.
+func mergeLogs() error {
+	paths, err := filepath.Glob(filepath.Join(workspace, "*"+mergeSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	readers := make([]*bufio.Reader, len(paths))
+	sources := make([]string, len(paths))
+	records := &mergeHeap{}
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		readers[i] = bufio.NewReader(file)
+		sources[i] = streamFiles[strings.TrimSuffix(filepath.Base(path), mergeSuffix)]
+		if err := pushMergeRecord(records, readers[i], i); err != nil {
+			return err
+		}
+	}
+
+	merged, err := os.Create(filepath.Join(workspace, "merged.log"))
+	if err != nil {
+		return err
+	}
+	defer merged.Close()
+
+	writer := bufio.NewWriterSize(merged, writeBufferBytes)
+	for records.Len() > 0 {
+		record := heap.Pop(records).(mergeRecord)
+		if mergePrefix {
+			writer.WriteString("[" + sources[record.source] + "] ")
+		}
+		writer.WriteString(record.line)
+		writer.WriteString(lineTerminator)
+
+		if err := pushMergeRecord(records, readers[record.source], record.source); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	return merged.Sync()
+}
+
+// pushMergeRecord reads the next event of a stream into the heap, nothing being pushed at the end of the stream.
+func pushMergeRecord(records *mergeHeap, reader io.Reader, source int) error {
+	timestamp, line, err := readMergeRecord(reader)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	heap.Push(records, mergeRecord{timestamp, line, source})
+
+	return nil
+}
+
+// walker calls a function for each file which must be added to an archive.
+type walker func(fn func(path string, info os.FileInfo) error) error
+
+// archiveLogs compressed all downloaded logs into a tar.gz archive, or directly into a gzip file without tar wrapping.
+func archiveLogs(archive io.Writer) error {
+	return archiveFiles(archive, path.Base(archiveName()), walkArchivable)
+}
+
+// archiveFiles compresses the files of the walker into an archive, named after the given file name.
+func archiveFiles(archive io.Writer, name string, walk walker) error {
+	output := &limitedWriter{output: archive, limit: maxTotalBytes}
+	if noTar && perFileGzip {
+		// Each stream file is a complete gzip member, members are concatenated into a multistream gzip file.
+		return walk(func(path string, info os.FileInfo) error {
+			return appendToArchive(output, path)
+		})
+	}
+
+	compressor, err := newCompressor(output, name)
+	if err != nil {
+		return err
+	}
+
+	if noTar {
+		err = walk(func(path string, info os.FileInfo) error {
+			return appendToArchive(compressor, path)
+		})
+	} else {
+		err = tarLogs(compressor, walk)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The writer is explicitly closed as its footer may fail to be written.
+	return compressor.Close()
+}
+
+// boundedCompressor compresses into a gzip writer once a compression slot is available, so that concurrent downloads
+// never compress more log files at once than the compression-concurrency flag.
+type boundedCompressor struct {
+	gw *gzip.Writer
+}
+
+// Write compresses the bytes while holding a compression slot.
+func (c boundedCompressor) Write(p []byte) (int, error) {
+	compressionSlots <- struct{}{}
+	defer func() { <-compressionSlots }()
+
+	return c.gw.Write(p)
+}
+
+// Close flushes the remaining compressed bytes while holding a compression slot.
+func (c boundedCompressor) Close() error {
+	compressionSlots <- struct{}{}
+	defer func() { <-compressionSlots }()
+
+	return c.gw.Close()
+}
+
+// limitedWriter fails as soon as more bytes than its limit have been written, a limit of 0 meaning no limit.
+type limitedWriter struct {
+	output  io.Writer
+	limit   int64
+	written int64
+}
+
+// Write writes into the underlying writer unless the limit would be exceeded.
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.written+int64(len(p)) > w.limit {
+		return 0, fmt.Errorf("the archive exceeds the maximum size of %d bytes (at least %d bytes)", w.limit, w.written+int64(len(p)))
+	}
+
+	n, err := w.output.Write(p)
+	w.written += int64(n)
+
+	return n, err
+}
+
+// tarLogs writes the files of the walker into a tarball.
+func tarLogs(output io.Writer, walk walker) error {
+	tw := tar.NewWriter(output)
+
+	prefix := entryPrefix()
+	if err := addDirectories(tw, prefix); err != nil {
+		return err
+	}
+
+	err := walk(func(path string, info os.FileInfo) error {
+		return addToArchive(tw, prefix, path, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// entryPrefix renders the directory under which entries are stored in the tarball, with a trailing slash if not empty.
+func entryPrefix() string {
+	prefix := strings.NewReplacer("{env}", environment, "{date}", startDate.Format(dateFormat)).Replace(tarPrefix)
+	if prefix = strings.Trim(path.Clean("/"+prefix), "/"); len(prefix) == 0 {
+		return ""
+	}
+
+	return prefix + "/"
+}
+
+// addDirectories writes a header for each directory of the entry prefix, so that they are restored with sane modes.
+func addDirectories(tw *tar.Writer, prefix string) error {
+	directory := ""
+	for _, element := range strings.Split(prefix, "/") {
+		if len(element) == 0 {
+			continue
+		}
+
+		directory += element + "/"
+		header := &tar.Header{
+			Name:     directory,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  time.Now(),
+		}
+		setOwnership(header)
+		normalizeHeader(header)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setOwnership applies the configured owner and group to a tar header.
+func setOwnership(header *tar.Header) {
+	header.Uid, header.Gid = tarUID, tarGID
+	header.Uname, header.Gname = tarUname, tarGname
+}
+
+// normalizeHeader replaces the metadata of the workspace files with fixed values in reproducible mode, so that identical
+// logs always produce identical archives. Entries are already added in lexical order, with the configured ownership.
+func normalizeHeader(header *tar.Header) {
+	if !reproducible {
+		return
+	}
+
+	header.ModTime = startDate
+	if header.Typeflag == tar.TypeReg {
+		header.Mode = 0644
+	}
+}
+
+// walkArchivable calls the function for each workspace file which must be added to the archive.
+func walkArchivable(fn func(path string, info os.FileInfo) error) error {
+	return filepath.Walk(workspace, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// The staged archive must not be added to itself, its name ending with ".log.gz" with the no-tar flag.
+		if !info.IsDir() && isArchivable(info.Name()) && path != stagedArchivePath() {
+			return fn(path, info)
+		}
+
+		return nil
+	})
+}
+
+// appendToArchive copies the content of a workspace file into the archive.
+func appendToArchive(output io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(output, file)
+
+	return err
+}
+
+// nopCompressor writes the archive as is, without any compression.
+type nopCompressor struct {
+	io.Writer
+}
+
+// Close does nothing, as there is no footer to write.
+func (nopCompressor) Close() error {
+	return nil
+}
+
+// newCompressor returns the writer compressing the archive with the configured format.
+func newCompressor(archive io.Writer, name string) (io.WriteCloser, error) {
+	header := gzipHeader(strings.TrimSuffix(name, formatExtensions[archiveFormat]))
+
+	switch {
+	case archiveFormat == "none":
+		return nopCompressor{archive}, nil
+	case archiveFormat == "bzip2":
+		return bzip2.NewWriter(archive, &bzip2.WriterConfig{Level: bzip2.DefaultCompression})
+	case archiveFormat == "snappy":
+		// The Snappy framing format is produced, which can be read by any Snappy implementation.
+		return s2.NewWriter(archive, s2.WriterSnappyCompat()), nil
+	case parallelGzip:
+		pw := pgzip.NewWriter(archive)
+		pw.Name, pw.Comment, pw.ModTime = header.Name, header.Comment, header.ModTime
+		return pw, nil
+	default:
+		gw := gzip.NewWriter(archive)
+		gw.Header = header
+		return gw, nil
+	}
+}
+
+// gzipHeader returns the header of a gzip file, which records the name of the compressed file and the configured
+// comment for restore pipelines. Names which cannot be stored in the Latin-1 header are left out.
+func gzipHeader(name string) gzip.Header {
+	header := gzip.Header{Comment: gzipComment, ModTime: gzipModTime()}
+	if isLatin1(name) {
+		header.Name = name
+	}
+
+	return header
+}
+
+// isLatin1 checks whether a string can be stored in a gzip header, which only supports Latin-1 text without NUL bytes.
+func isLatin1(value string) bool {
+	for _, r := range value {
+		if r == 0 || r > unicode.MaxLatin1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// gzipModTime returns the modification time of gzip headers, the start of the archived day in reproducible mode and
+// none otherwise.
+func gzipModTime() time.Time {
+	if reproducible {
+		return startDate
+	}
+
+	return time.Time{}
+}
+
+// addToArchive writes a workspace file into the tarball.
+func addToArchive(tw *tar.Writer, prefix string, path string, info os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Files of log group trees are stored in sub-directories of the workspace, which are kept in the tarball.
+	entry, err := filepath.Rel(workspace, path)
+	if err != nil {
+		return err
+	}
+	entry = filepath.ToSlash(entry)
+
+	header := new(tar.Header)
+	header.Name = prefix + entry
+	header.Size = info.Size()
+	header.Typeflag = tar.TypeReg
+	header.Mode = int64(info.Mode().Perm())
+	header.ModTime = info.ModTime()
+
+	// The original stream name is kept when it had to be changed to get a valid and unique file name.
+	name := strings.TrimSuffix(entry, ".gz")
+	if stream, ok := streamFiles[name]; ok && stream+".log" != filepath.Base(name) {
+		header.PAXRecords = map[string]string{streamPAXRecord: stream}
+	}
+
+	setOwnership(header)
+	normalizeHeader(header)
+
+	// write the header to the tarball archive
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// copy the file data to the tarball
+	_, err = io.Copy(tw, file)
+
+	return err
+}
+
+// isArchivable checks whether a workspace file must be added to the archive.
+func isArchivable(name string) bool {
+	return strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz") || contains([]string{"insights.csv", "insights.json", readmeName}, name)
+}
+
+// writeReadme writes a README into the workspace, describing the content of the archive and how to extract it.
+func writeReadme() error {
+	if !includeReadme {
+		return nil
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "Logs of the \"%s\" environment, archived from the \"%s\" log group.\n", environment, logGroup)
+	fmt.Fprintf(&content, "Period: from %s to %s.\n\n", startDate.UTC().Format(time.RFC3339), endDate.UTC().Format(time.RFC3339))
+
+	if len(insightsQuery) > 0 {
+		fmt.Fprintf(&content, "The insights.%s file holds the results of the following Logs Insights query:\n  %s\n", insightsFormat, insightsQuery)
+	}
+
+	files := make([]string, 0, len(streamFiles))
+	for file := range streamFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	layout := "each one being stored in its own file"
+	if mergeMode {
+		layout = "their events being interleaved in the merged.log file"
+	}
+
+	fmt.Fprintf(&content, "Log streams (%d), %s:\n", len(files), layout)
+	for _, file := range files {
+		fmt.Fprintf(&content, "  %s: %s\n", file, streamFiles[file])
+	}
+
+	fmt.Fprintf(&content, "\nTo extract the archive:\n  %s\n", extractCommand())
+	if perFileGzip {
+		content.WriteString("Each log file is compressed, to decompress them:\n  gunzip *.log.gz\n")
+	}
+
+	return os.WriteFile(workspace+string(os.PathSeparator)+readmeName, []byte(content.String()), 0644)
+}
+
+// extractCommand returns the command extracting the archive, depending on its compression format.
+func extractCommand() string {
+	name := path.Base(archiveName())
+	if archiveFormat == "snappy" {
+		return fmt.Sprintf("s2d -c %s | tar -xf -", name)
+	}
+
+	options := map[string]string{"gzip": "xzf", "bzip2": "xjf", "none": "xf"}
+
+	return fmt.Sprintf("tar -%s %s", options[archiveFormat], name)
+}
+
+// uploadPresigned uploads the generated archive with a PUT request to the presigned URL, which is never logged as it
+// grants access to the destination.
+func uploadPresigned(ctx context.Context, archive *os.File) error {
+	duration, _ := time.ParseDuration(timeout)
+
+	ctx, cancelFn := context.WithTimeout(ctx, duration)
+	defer cancelFn()
+
+	info, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, archive)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+
+	// The URL is stripped from request errors, as it contains the signature.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload the archive to the presigned URL, %v", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to upload the archive to the presigned URL, %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	logInfo("Logs successfully uploaded to the presigned URL.")
+
+	return nil
+}
+
+// uploadArchives uploads the generated archive to every destination bucket, failing only if all uploads failed.
+func uploadArchives(ctx context.Context, archive *os.File, key string, checksum string) ([]BucketResult, error) {
+	results := make([]BucketResult, 0, len(buckets))
+	failures := 0
+	upload := uploadArchive
+	if destinationType == "gcs" {
+		upload = uploadGCSArchive
+	}
+
+	for _, destination := range buckets {
+		result := BucketResult{Bucket: destination}
+		err := traceStage(ctx, "upload", func(ctx context.Context) error {
+			return upload(ctx, archive, destination, key, checksum)
+		})
+		if err != nil {
+			log.Println(err)
+			result.Error = err.Error()
+			failures++
+		}
+
+		results = append(results, result)
+	}
+
+	if failures == len(buckets) {
+		return results, errors.New("failed to upload the archive to any bucket")
+	}
+
+	return results, nil
+}
+
+// uploadArchive uploads the generated archive to an S3 bucket.
+func uploadArchive(ctx context.Context, archive *os.File, destination string, key string, checksum string) error {
+	duration, _ := time.ParseDuration(timeout)
+
+	// The verification downloads the whole archive again, it's therefore bounded by its own timeout.
+	uploadCtx, cancelFn := context.WithTimeout(ctx, duration)
+	defer cancelFn()
+
+	client, err := s3Client(uploadCtx, destination)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the region of \"%s\", %v", destination, err)
+	}
+	if err := checkOverwrite(uploadCtx, client, destination, key); err != nil {
+		return err
+	}
+
+	// The same archive may be uploaded several times, it must therefore always be read from the beginning.
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	input := putObjectInput(destination, key, archive)
+	input.Metadata = archiveMetadata
+	err = newObjectsAPI(client).PutObject(uploadCtx, input)
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			return fmt.Errorf("upload to \"%s\" canceled due to timeout, %v", destination, err)
+		}
+
+		return fmt.Errorf("failed to upload the archive to \"%s\", %v", destination, err)
+	}
+
+	logInfo(fmt.Sprintf("Logs successfully uploaded to \"%s\".", destination))
+
+	return finalizeUpload(ctx, client, destination, key, checksum)
+}
+
+// objectMetadata returns the metadata of the archive, made of the user-defined values and of automatic values
+// describing its content.
+func objectMetadata(summary RunSummary) map[string]*string {
+	metadata := make(map[string]*string, len(metadataValues)+3)
+	for key, value := range metadataValues {
+		metadata[key] = aws.String(value)
+	}
+
+	metadata["environment"] = aws.String(environment)
+	metadata["target-date"] = aws.String(startDate.Format("2006-01-02"))
+	metadata["event-count"] = aws.String(strconv.FormatInt(summary.Events, 10))
+
+	return metadata
+}
+
+// parseMetadata parses a comma-separated list of key=value pairs, automatic keys being reserved.
+func parseMetadata(list string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range splitList(list) {
+		i := strings.Index(pair, "=")
+		if i < 0 || len(strings.TrimSpace(pair[:i])) == 0 {
+			panic(fmt.Errorf("a valid metadata pair must be provided (key=value), got \"%s\"", pair))
+		}
+
+		key, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if contains([]string{"environment", "target-date", "event-count"}, strings.ToLower(key)) {
+			panic(fmt.Errorf("the \"%s\" metadata key is reserved", key))
+		}
+
+		values[key] = value
+	}
+
+	return values
+}
+
+// putObjectInput creates the input of a PutObject request with the configured ACL, storage class and expected bucket
+// owner.
+func putObjectInput(destination string, key string, body io.ReadSeeker) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(destination),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if len(objectACL) > 0 {
+		input.ACL = aws.String(objectACL)
+	}
+	if len(storageClass) > 0 {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if len(expectedBucketOwner) > 0 {
+		input.ExpectedBucketOwner = aws.String(expectedBucketOwner)
+	}
+
+	return input
+}
+
+// finalizeUpload verifies the uploaded archive and writes its checksum sidecar, depending on the configuration.
+func finalizeUpload(ctx context.Context, client *s3.S3, destination string, key string, checksum string) error {
+	if verifyUpload {
+		if err := verifyArchive(ctx, client, destination, key, checksum); err != nil {
+			return err
+		}
+	}
+
+	if writeChecksumFile {
+		return uploadChecksum(ctx, client, destination, key, checksum)
+	}
+
+	return nil
+}
+
+// uploadChecksum uploads a "{key}.sha256" sidecar object next to the archive, using the sha256sum format.
+func uploadChecksum(ctx context.Context, client *s3.S3, destination string, key string, checksum string) error {
+	duration, _ := time.ParseDuration(timeout)
+
+	ctx, cancelFn := context.WithTimeout(ctx, duration)
+	defer cancelFn()
+
+	content := fmt.Sprintf("%s  %s\n", checksum, path.Base(key))
+	if err := newObjectsAPI(client).PutObject(ctx, putObjectInput(destination, key+".sha256", strings.NewReader(content))); err != nil {
+		return fmt.Errorf("failed to upload the checksum file to \"%s\", %v", destination, err)
+	}
+
+	return nil
+}
+
+// streamUploadArchive uploads the archive while it's being generated and returns its checksum.
+func streamUploadArchive(ctx context.Context, destination string, key string) (string, error) {
+	duration, _ := time.ParseDuration(timeout)
+
+	// The upload lasts as long as the compression of the whole day, only the calls preceding it are bounded by the
+	// timeout, the upload itself being bounded by the deadline of the run.
+	checkCtx, cancelFn := context.WithTimeout(ctx, duration)
+	defer cancelFn()
+
+	client, err := s3Client(checkCtx, destination)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the region of \"%s\", %v", destination, err)
+	}
+	if err := checkOverwrite(checkCtx, client, destination, key); err != nil {
+		return "", err
+	}
+
+	reader, writer := io.Pipe()
+	hash := sha256.New()
+	go func() {
+		writer.CloseWithError(traceStage(ctx, "archive", func(context.Context) error {
+			return archiveLogs(io.MultiWriter(writer, hash))
+		}))
+	}()
+
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(destination),
+		Key:      aws.String(key),
+		Body:     reader,
+		Metadata: archiveMetadata,
+	}
+	if len(objectACL) > 0 {
+		input.ACL = aws.String(objectACL)
+	}
+	if len(storageClass) > 0 {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if len(expectedBucketOwner) > 0 {
+		input.ExpectedBucketOwner = aws.String(expectedBucketOwner)
+	}
+
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		u.PartSize = uploadPartSize
+		u.Concurrency = uploadConcurrency
+	})
+	if _, err := uploader.UploadWithContext(ctx, input); err != nil {
+		// Unblock the archiving goroutine which may still be writing into the pipe.
+		reader.CloseWithError(err)
+		return "", fmt.Errorf("failed to stream the archive to \"%s\", %v", destination, err)
+	}
+
+	logInfo(fmt.Sprintf("Logs successfully streamed to \"%s\".", destination))
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	return checksum, finalizeUpload(ctx, client, destination, key, checksum)
+}
+
+// verifyArchive downloads the uploaded archive and checks whether its checksum matches the local one.
+func verifyArchive(ctx context.Context, client *s3.S3, destination string, key string, checksum string) error {
+	if verifyTimeout > 0 {
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(ctx, verifyTimeout)
+		defer cancelFn()
+	}
+
+	exists, err := objectExists(ctx, client, destination, key)
+	if err != nil {
+		return fmt.Errorf("failed to check whether the archive exists on \"%s\", %v", destination, err)
+	}
+	if !exists {
+		return fmt.Errorf("archive not found on \"%s\" after its upload", destination)
+	}
+
+	object, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(destination),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download the archive from \"%s\" for verification, %v", destination, err)
+	}
+	defer object.Body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, object.Body); err != nil {
+		return fmt.Errorf("failed to read the archive from \"%s\" for verification, %v", destination, err)
+	}
+
+	if remote := hex.EncodeToString(hash.Sum(nil)); remote != checksum {
+		return fmt.Errorf("archive uploaded to \"%s\" is corrupted (expected %s, got %s)", destination, checksum, remote)
+	}
+
+	logInfo(fmt.Sprintf("Archive successfully verified on \"%s\".", destination))
+
+	return nil
+}
+
+// checkOverwrite fails when the archive already exists in a bucket and must not be overwritten.
+func checkOverwrite(ctx context.Context, client *s3.S3, destination string, key string) error {
+	if overwrite {
+		return nil
+	}
+
+	exists, err := objectExists(ctx, client, destination, key)
+	if err != nil {
+		return fmt.Errorf("failed to check whether the archive exists on \"%s\", %v", destination, err)
+	}
+	if exists {
+		return fmt.Errorf("archive \"%s\" already exists on \"%s\" and must not be overwritten", key, destination)
+	}
+
+	return nil
+}
+
+// objectExists checks whether an object exists in a bucket, transient errors being retried.
+func objectExists(ctx context.Context, client *s3.S3, destination string, key string) (bool, error) {
+	err := retry(ctx, func() error {
+		_, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(destination),
+			Key:    aws.String(key),
+		}, withoutSDKRetries)
+		return err
+	})
+
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// retry calls an operation until it succeeds, fails with a non-transient error or exhausts all attempts.
+func retry(ctx context.Context, operation func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt > maxRetries || !isTransient(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+}
+
+// retryDelay returns the delay before a retry (1 being the first one), doubled after each attempt up to the maximum.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	return delay
+}
+
+// withAPITimeout runs a CloudWatch API call with its own deadline, distinct from the one of the whole process.
+func withAPITimeout(ctx context.Context, call func(ctx context.Context) error) error {
+	if apiTimeout <= 0 {
+		return call(ctx)
+	}
+
+	callCtx, cancelFn := context.WithTimeout(ctx, apiTimeout)
+	defer cancelFn()
+
+	// Only the call has timed out when the parent context is still alive, which is worth retrying.
+	err := call(callCtx)
+	if err != nil && ctx.Err() == nil && callCtx.Err() == context.DeadlineExceeded {
+		return errAPITimeout
+	}
+
+	return err
+}
+
+// isTransient checks whether an AWS error is worth retrying (throttling, server-side failures, timed out calls or one of
+// the retriable codes).
+func isTransient(err error) bool {
+	if err == errAPITimeout {
+		return true
+	}
+
+	// Errors of the second version of the SDK have already been retried by the SDK itself, with the same options.
+	if _, ok := err.(awserr.Error); !ok {
+		return false
+	}
+	if isRetriableCode(err) {
+		return true
+	}
+
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// isRetriableCode checks whether the code of an AWS error is one of the retriable codes.
+func isRetriableCode(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && contains(retriableCodes, aerr.Code())
+}
+
+// archiveChecksum computes the SHA-256 checksum of the archive.
+func archiveChecksum(archive *os.File) (string, error) {
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, archive); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// s3Client returns an S3 client targeting the region where the bucket is located.
+func s3Client(ctx context.Context, destination string) (*s3.S3, error) {
+	region, err := bucketRegion(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if region == aws.StringValue(s3Service.Config.Region) {
+		return s3Service, nil
+	}
+
+	client := s3.New(awsSession, s3Config().WithRegion(region))
+	traceClient(client.Client)
+
+	return client, nil
+}
+
+// s3Config returns the configuration of the S3 clients, whose calls are retried by the SDK with the retry options of the
+// process, as most of them are not retried by the process itself.
+func s3Config() *aws.Config {
+	return request.WithRetryer(aws.NewConfig(), s3Retryer{client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinRetryDelay:    retryBaseDelay,
+		MaxRetryDelay:    retryMaxDelay,
+		MinThrottleDelay: retryBaseDelay,
+		MaxThrottleDelay: retryMaxDelay,
+	}})
+}
+
+// s3Retryer retries the errors retried by default by the SDK, and the retriable codes.
+type s3Retryer struct {
+	client.DefaultRetryer
+}
+
+// ShouldRetry tells whether a failed S3 call must be retried.
+func (r s3Retryer) ShouldRetry(req *request.Request) bool {
+	return isRetriableCode(req.Error) || r.DefaultRetryer.ShouldRetry(req)
+}
+
+// withoutSDKRetries disables the retries of the SDK for an S3 call which is already retried by the process.
+func withoutSDKRetries(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
+// bucketRegion returns the region of a bucket, which is directly part of the ARN of access points.
+func bucketRegion(ctx context.Context, destination string) (string, error) {
+	accessPoint, err := parseAccessPoint(destination)
+	if err != nil {
+		return "", err
+	}
+
+	if accessPoint != nil {
+		return accessPoint.Region, nil
+	}
+
+	// Directory buckets are zonal, they can only be reached from the region of the session.
+	if isDirectoryBucket(destination) {
+		return aws.StringValue(s3Service.Config.Region), nil
+	}
+
+	return s3manager.GetBucketRegionWithClient(ctx, s3Service, destination)
+}
+
+// parseAccessPoint parses an S3 access point ARN, nil being returned if the destination is a plain bucket name.
+func parseAccessPoint(destination string) (*arn.ARN, error) {
+	if !arn.IsARN(destination) {
+		return nil, nil
+	}
+
+	accessPoint, err := arn.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessPoint.Service != "s3" || !strings.HasPrefix(accessPoint.Resource, "accesspoint/") ||
+		len(accessPoint.Region) == 0 || len(accessPoint.AccountID) == 0 {
+		return nil, fmt.Errorf("\"%s\" is not a valid S3 access point ARN (arn:aws:s3:region:account-id:accesspoint/name)", destination)
+	}
+
+	return &accessPoint, nil
+}
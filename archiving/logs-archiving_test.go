@@ -0,0 +1,3169 @@
+package archiving
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/s2"
+)
+
+// fakeRegion is the region of the fake AWS services and of their buckets.
+const fakeRegion = "eu-west-1"
+
+// fakeAWS emulates the CloudWatch Logs and S3 APIs behind the HTTP client of the AWS services, so that the archiving
+// process runs unchanged against it with both versions of the SDK.
+type fakeAWS struct {
+	mutex    sync.Mutex
+	groups   map[string][]*fakeStream
+	objects  map[string][]byte
+	pageSize int
+	handlers map[string]func(req fakeRequest) *fakeResponse
+	requests []fakeRequest
+}
+
+// fakeStream is a log stream of the fake CloudWatch Logs API.
+type fakeStream struct {
+	Name        string
+	Events      []fakeEvent
+	StoredBytes int64
+	Retention   int64
+}
+
+// fakeEvent is a log event of a fake stream, a nil message being a metadata-only event.
+type fakeEvent struct {
+	Timestamp     int64
+	IngestionTime int64
+	Message       *string
+}
+
+// fakeRequest is a request received by the fake services.
+type fakeRequest struct {
+	Operation string
+	Bucket    string
+	Key       string
+	Header    http.Header
+	Query     url.Values
+	Input     map[string]interface{}
+	Body      []byte
+	Deadline  time.Time
+}
+
+// fakeResponse is the response of a fake operation, bodies which are not strings being encoded as JSON.
+type fakeResponse struct {
+	Status int
+	Header map[string]string
+	Body   interface{}
+}
+
+// useFakeAWS creates the service clients on top of fake AWS services, for the duration of the test.
+func useFakeAWS(t *testing.T) *fakeAWS {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", os.DevNull)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_REQUEST_CHECKSUM_CALCULATION", "when_required")
+	t.Setenv("AWS_RESPONSE_CHECKSUM_VALIDATION", "when_required")
+
+	fake := &fakeAWS{
+		groups:   make(map[string][]*fakeStream),
+		objects:  make(map[string][]byte),
+		pageSize: 10000,
+		handlers: make(map[string]func(req fakeRequest) *fakeResponse),
+	}
+
+	setValue(t, &region, fakeRegion)
+	setValue(t, &profile, "")
+	setValue(t, &awsTransport, http.RoundTripper(fake))
+	resetServices()
+	loadServices()
+	t.Cleanup(resetServices)
+
+	return fake
+}
+
+// addStreams adds log streams to a log group of the fake services.
+func (f *fakeAWS) addStreams(group string, streams ...*fakeStream) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.groups[group] = append(f.groups[group], streams...)
+}
+
+// handle overrides the behavior of an operation, nil responses falling back to the default behavior.
+func (f *fakeAWS) handle(operation string, handler func(req fakeRequest) *fakeResponse) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.handlers[operation] = handler
+}
+
+// object returns the content of an uploaded object, keys being compared without their leading slash.
+func (f *fakeAWS) object(bucket string, key string) ([]byte, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	content, ok := f.objects[bucket+"/"+strings.TrimLeft(key, "/")]
+	return content, ok
+}
+
+// calls returns the requests received for an operation.
+func (f *fakeAWS) calls(operation string) []fakeRequest {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var calls []fakeRequest
+	for _, req := range f.requests {
+		if req.Operation == operation {
+			calls = append(calls, req)
+		}
+	}
+	return calls
+}
+
+// RoundTrip answers the requests of the AWS SDK without any network access.
+func (f *fakeAWS) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := fakeRequest{Header: r.Header.Clone(), Query: r.URL.Query()}
+	req.Deadline, _ = r.Context().Deadline()
+	if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+
+	if target := r.Header.Get("X-Amz-Target"); len(target) > 0 {
+		req.Operation = target[strings.LastIndex(target, ".")+1:]
+		json.Unmarshal(req.Body, &req.Input)
+	} else {
+		req.Bucket, req.Key = s3Location(r.URL)
+		req.Operation = s3Operation(r.Method, req.Key, req.Query)
+	}
+
+	f.mutex.Lock()
+	f.requests = append(f.requests, req)
+	handler := f.handlers[req.Operation]
+	f.mutex.Unlock()
+
+	var response *fakeResponse
+	if handler != nil {
+		response = handler(req)
+	}
+	if response == nil {
+		response = f.respond(req)
+	}
+
+	// Requests canceled while being handled fail as with a real transport.
+	if err := r.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	return response.http(r), nil
+}
+
+// s3Location extracts the bucket and the key of an S3 request, with either a virtual-hosted or a path-style URL.
+func s3Location(u *url.URL) (string, string) {
+	host, objectPath := u.Hostname(), strings.TrimLeft(u.Path, "/")
+	if i := strings.Index(host, ".s3"); i > 0 {
+		return host[:i], objectPath
+	}
+
+	parts := strings.SplitN(objectPath, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimLeft(parts[1], "/")
+}
+
+// s3Route identifies an S3 operation by its method, whether it targets an object and its multipart query parameter.
+type s3Route struct {
+	method    string
+	object    bool
+	multipart string
+}
+
+// s3Operations names the S3 operations used by the archiving process.
+var s3Operations = map[s3Route]string{
+	{method: http.MethodHead}:                                        "HeadBucket",
+	{method: http.MethodHead, object: true}:                          "HeadObject",
+	{method: http.MethodGet}:                                         "ListObjectsV2",
+	{method: http.MethodGet, object: true}:                           "GetObject",
+	{method: http.MethodPost, object: true, multipart: "uploads"}:    "CreateMultipartUpload",
+	{method: http.MethodPost, object: true, multipart: "uploadId"}:   "CompleteMultipartUpload",
+	{method: http.MethodPut, object: true, multipart: "uploadId"}:    "UploadPart",
+	{method: http.MethodPut, object: true}:                           "PutObject",
+	{method: http.MethodDelete, object: true, multipart: "uploadId"}: "AbortMultipartUpload",
+	{method: http.MethodDelete, object: true}:                        "DeleteObject",
+}
+
+// s3Operation names the S3 operation of a request.
+func s3Operation(method string, key string, query url.Values) string {
+	route := s3Route{method: method, object: len(key) > 0}
+	for _, name := range []string{"uploads", "uploadId"} {
+		if _, ok := query[name]; ok {
+			route.multipart = name
+		}
+	}
+
+	if operation, ok := s3Operations[route]; ok {
+		return operation
+	}
+	return method
+}
+
+// respond gives the default response of an operation.
+func (f *fakeAWS) respond(req fakeRequest) *fakeResponse {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch req.Operation {
+	case "DescribeLogGroups":
+		return f.describeLogGroups(req)
+	case "DescribeLogStreams":
+		return f.describeLogStreams(req)
+	case "GetLogEvents":
+		return f.getLogEvents(req)
+	case "HeadBucket":
+		return &fakeResponse{Status: http.StatusOK, Header: map[string]string{"X-Amz-Bucket-Region": fakeRegion}}
+	case "PutObject":
+		f.objects[req.Bucket+"/"+req.Key] = req.Body
+		return &fakeResponse{Status: http.StatusOK, Header: map[string]string{"ETag": `"etag"`}}
+	case "DeleteObject":
+		delete(f.objects, req.Bucket+"/"+req.Key)
+		return &fakeResponse{Status: http.StatusNoContent}
+	case "HeadObject", "GetObject":
+		return f.getObject(req)
+	case "ListObjectsV2":
+		return f.listObjects(req)
+	case "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload", "AbortMultipartUpload":
+		return f.multipartUpload(req)
+	}
+
+	return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{}}
+}
+
+// describeLogGroups lists the log groups matching the prefix.
+func (f *fakeAWS) describeLogGroups(req fakeRequest) *fakeResponse {
+	prefix, _ := req.Input["logGroupNamePrefix"].(string)
+
+	var names []string
+	for name := range f.groups {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	groups := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		group := map[string]interface{}{"logGroupName": name}
+		if streams := f.groups[name]; len(streams) > 0 && streams[0].Retention > 0 {
+			group["retentionInDays"] = streams[0].Retention
+		}
+		groups = append(groups, group)
+	}
+
+	return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{"logGroups": groups}}
+}
+
+// describeLogStreams lists the log streams of a group matching the prefix, paginated by the limit of the request.
+func (f *fakeAWS) describeLogStreams(req fakeRequest) *fakeResponse {
+	group, _ := req.Input["logGroupName"].(string)
+	prefix, _ := req.Input["logStreamNamePrefix"].(string)
+	limit := 50
+	if value, ok := req.Input["limit"].(float64); ok {
+		limit = int(value)
+	}
+	offset := 0
+	if token, ok := req.Input["nextToken"].(string); ok {
+		offset, _ = strconv.Atoi(token)
+	}
+
+	var matching []*fakeStream
+	for _, stream := range f.groups[group] {
+		if strings.HasPrefix(stream.Name, prefix) {
+			matching = append(matching, stream)
+		}
+	}
+
+	body := map[string]interface{}{}
+	end := offset + limit
+	if end < len(matching) {
+		body["nextToken"] = strconv.Itoa(end)
+	} else {
+		end = len(matching)
+	}
+
+	streams := make([]map[string]interface{}, 0, end-offset)
+	for _, stream := range matching[offset:end] {
+		description := map[string]interface{}{"logStreamName": stream.Name, "storedBytes": stream.StoredBytes}
+		if len(stream.Events) > 0 {
+			description["firstEventTimestamp"] = stream.Events[0].Timestamp
+			description["lastEventTimestamp"] = stream.Events[len(stream.Events)-1].Timestamp
+			description["lastIngestionTime"] = stream.Events[len(stream.Events)-1].IngestionTime
+		}
+		streams = append(streams, description)
+	}
+	body["logStreams"] = streams
+
+	return &fakeResponse{Status: http.StatusOK, Body: body}
+}
+
+// getLogEvents returns a page of the events of a stream within the time window, following forward or backward tokens.
+func (f *fakeAWS) getLogEvents(req fakeRequest) *fakeResponse {
+	group, _ := req.Input["logGroupName"].(string)
+	name, _ := req.Input["logStreamName"].(string)
+	start, _ := req.Input["startTime"].(float64)
+	end, _ := req.Input["endTime"].(float64)
+	fromHead, _ := req.Input["startFromHead"].(bool)
+
+	events := f.streamEvents(group, name, int64(start), int64(end))
+
+	low, high := 0, len(events)
+	token, _ := req.Input["nextToken"].(string)
+	switch {
+	case strings.HasPrefix(token, "f/"):
+		low, _ = strconv.Atoi(token[2:])
+		high = min(low+f.pageSize, len(events))
+	case strings.HasPrefix(token, "b/"):
+		high, _ = strconv.Atoi(token[2:])
+		low = max(high-f.pageSize, 0)
+	case fromHead:
+		high = min(f.pageSize, len(events))
+	default:
+		low = max(len(events)-f.pageSize, 0)
+	}
+
+	page := make([]map[string]interface{}, 0, high-low)
+	for _, event := range events[low:high] {
+		item := map[string]interface{}{"timestamp": event.Timestamp, "ingestionTime": event.IngestionTime}
+		if event.Message != nil {
+			item["message"] = *event.Message
+		}
+		page = append(page, item)
+	}
+
+	return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{
+		"events":            page,
+		"nextForwardToken":  fmt.Sprintf("f/%d", high),
+		"nextBackwardToken": fmt.Sprintf("b/%d", low),
+	}}
+}
+
+// streamEvents returns the events of a log stream within a time window, the first stream being used for duplicate names.
+func (f *fakeAWS) streamEvents(group string, name string, start int64, end int64) []fakeEvent {
+	var events []fakeEvent
+	for _, stream := range f.groups[group] {
+		if stream.Name != name {
+			continue
+		}
+		for _, event := range stream.Events {
+			if event.Timestamp >= start && event.Timestamp < end {
+				events = append(events, event)
+			}
+		}
+		break
+	}
+	return events
+}
+
+// getObject returns an uploaded object, or a NoSuchKey error.
+func (f *fakeAWS) getObject(req fakeRequest) *fakeResponse {
+	content, ok := f.objects[req.Bucket+"/"+req.Key]
+	if !ok {
+		return s3Error(http.StatusNotFound, "NoSuchKey")
+	}
+
+	if req.Operation == "HeadObject" {
+		return &fakeResponse{Status: http.StatusOK, Header: map[string]string{"Content-Length": strconv.Itoa(len(content))}}
+	}
+	return &fakeResponse{Status: http.StatusOK, Body: string(content)}
+}
+
+// listObjects lists the uploaded objects matching the prefix, two keys per page.
+func (f *fakeAWS) listObjects(req fakeRequest) *fakeResponse {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}
+
+	var keys []string
+	for location := range f.objects {
+		if key := strings.TrimPrefix(location, req.Bucket+"/"); key != location && strings.HasPrefix(key, strings.TrimLeft(req.Query.Get("prefix"), "/")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	offset, _ := strconv.Atoi(req.Query.Get("continuation-token"))
+	page := result{}
+	for i := offset; i < len(keys) && i < offset+2; i++ {
+		page.Contents = append(page.Contents, content{keys[i], len(f.objects[req.Bucket+"/"+keys[i]]), "2024-06-02T00:00:00.000Z"})
+	}
+	if offset+2 < len(keys) {
+		page.IsTruncated, page.NextContinuationToken = true, strconv.Itoa(offset+2)
+	}
+
+	body, _ := xml.Marshal(page)
+	return &fakeResponse{Status: http.StatusOK, Body: string(body)}
+}
+
+// multipartUpload stores the parts of a multipart upload, assembled into the object once it's completed.
+func (f *fakeAWS) multipartUpload(req fakeRequest) *fakeResponse {
+	location := req.Bucket + "/" + req.Key
+	switch req.Operation {
+	case "CreateMultipartUpload":
+		return &fakeResponse{Status: http.StatusOK, Body: fmt.Sprintf(
+			"<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>",
+			req.Bucket, req.Key)}
+	case "UploadPart":
+		f.objects[location+"#"+fmt.Sprintf("%05s", req.Query.Get("partNumber"))] = req.Body
+		return &fakeResponse{Status: http.StatusOK, Header: map[string]string{"ETag": `"part"`}}
+	case "CompleteMultipartUpload":
+		var parts []string
+		for key := range f.objects {
+			if strings.HasPrefix(key, location+"#") {
+				parts = append(parts, key)
+			}
+		}
+		sort.Strings(parts)
+
+		var content []byte
+		for _, part := range parts {
+			content = append(content, f.objects[part]...)
+			delete(f.objects, part)
+		}
+		f.objects[location] = content
+		return &fakeResponse{Status: http.StatusOK, Body: "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>"}
+	}
+
+	return &fakeResponse{Status: http.StatusNoContent}
+}
+
+// s3Error returns an S3 error response.
+func s3Error(status int, code string) *fakeResponse {
+	return &fakeResponse{Status: status, Body: fmt.Sprintf("<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)}
+}
+
+// logsError returns a CloudWatch Logs error response.
+func logsError(status int, code string) *fakeResponse {
+	return &fakeResponse{
+		Status: status,
+		Header: map[string]string{"X-Amzn-Errortype": code},
+		Body:   map[string]interface{}{"__type": code, "message": code},
+	}
+}
+
+// http converts the fake response into an HTTP response.
+func (r *fakeResponse) http(req *http.Request) *http.Response {
+	var body []byte
+	switch value := r.Body.(type) {
+	case nil:
+	case string:
+		body = []byte(value)
+	default:
+		body, _ = json.Marshal(value)
+	}
+
+	header := http.Header{"X-Amzn-Requestid": {"request"}, "X-Amz-Request-Id": {"request"}}
+	for key, value := range r.Header {
+		header.Set(key, value)
+	}
+	if len(header.Get("Content-Length")) == 0 {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// setValue changes a package variable for the duration of the test.
+func setValue[T any](t *testing.T, variable *T, value T) {
+	t.Helper()
+	previous := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = previous })
+}
+
+// configure loads the options of a run with the default test options, as ArchiveGroup would.
+func configure(t *testing.T, cfg Config) {
+	t.Helper()
+	options := testConfig(cfg)
+	loadConfig(options)
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+}
+
+// handlerArgs returns the command line of a handler invocation with the bucket, environment, day and region used by
+// tests, as the handler resets the other flags to their default value.
+func handlerArgs(args ...string) []string {
+	return append([]string{"logs-archiving", "-bucket", "archives", "-environment", "prod", "-target", "2024-06-01",
+		"-region", fakeRegion}, args...)
+}
+
+// testConfig completes the options with the bucket, environment, day and region used by tests.
+func testConfig(cfg Config) Config {
+	options := Config{"bucket": "archives", "environment": "prod", "target": "2024-06-01", "region": fakeRegion}
+	for name, value := range cfg {
+		options[name] = value
+	}
+	return options
+}
+
+// at returns the Unix time in milliseconds of a time of the archived day (e.g. "13:04:05.000").
+func at(clock string) int64 {
+	t, err := time.Parse("2006-01-02 15:04:05.000", "2024-06-01 "+clock)
+	if err != nil {
+		panic(err)
+	}
+	return toMillis(t)
+}
+
+// events creates the events of a fake stream from messages, one second apart from midnight.
+func events(messages ...string) []fakeEvent {
+	list := make([]fakeEvent, len(messages))
+	for i, message := range messages {
+		message := message
+		timestamp := at("00:00:00.000") + int64(i+1)*1000
+		list[i] = fakeEvent{Timestamp: timestamp, IngestionTime: timestamp + 500, Message: &message}
+	}
+	return list
+}
+
+// tarEntry is an entry read back from a tarball.
+type tarEntry struct {
+	header  *tar.Header
+	content string
+}
+
+// readTarGz returns the entries of a tar.gz archive by name.
+func readTarGz(t *testing.T, archive []byte) map[string]tarEntry {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("failed to read the gzip archive: %v", err)
+	}
+	return readTar(t, gr)
+}
+
+// readTar returns the entries of a tarball by name.
+func readTar(t *testing.T, archive io.Reader) map[string]tarEntry {
+	t.Helper()
+	entries := make(map[string]tarEntry)
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("failed to read the tarball: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read the \"%s\" entry: %v", header.Name, err)
+		}
+		entries[header.Name] = tarEntry{header, string(content)}
+	}
+}
+
+// archiveEntries runs the archiving process against the fake services and returns the entries of the uploaded archive.
+func archiveEntries(t *testing.T, fake *fakeAWS, cfg Config) (RunSummary, map[string]tarEntry) {
+	t.Helper()
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(cfg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	archive, ok := fake.object(summary.Buckets[0].Bucket, summary.Key)
+	if !ok {
+		t.Fatalf("the \"%s\" archive has not been uploaded", summary.Key)
+	}
+
+	return summary, readTarGz(t, archive)
+}
+
+// expectPanic runs a function which must panic, and returns the message of the panic.
+func expectPanic(t *testing.T, fn func()) (message string) {
+	t.Helper()
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("a panic was expected")
+		}
+		message = fmt.Sprint(r)
+	}()
+
+	fn()
+	return ""
+}
+
+func TestArchiveGroup(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	summary, entries := archiveEntries(t, fake, nil)
+	if !summary.Uploaded || summary.Events != 2 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if content := entries["web-1.log"].content; content != "first\nsecond\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestArchiveGroupReturnsErrors(t *testing.T) {
+	useFakeAWS(t)
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"format": "zip"})); err == nil {
+		t.Error("an invalid option must be returned as an error")
+	}
+}
+
+func TestArchiveStream(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("/aws/lambda/api",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	cfg := Config{"bucket": "archives", "target": "2024-06-01", "region": fakeRegion}
+	ref, err := ArchiveStream(context.Background(), cfg, "/aws/lambda/api", "web-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ref.Bucket != "archives" || ref.Key != "/aws_lambda_api/2024-06-01.tar.gz" || len(ref.Checksum) == 0 {
+		t.Errorf("the archive must be keyed by the log group without any environment: %+v", ref)
+	}
+	archive, _ := fake.object("archives", ref.Key)
+	if entries := readTarGz(t, archive); len(entries) != 1 || entries["web-1.log"].content != "first\n" {
+		t.Errorf("only the requested stream must be archived: %v", entries)
+	}
+
+	if _, err := ArchiveStream(context.Background(), cfg, "/aws/lambda/api", ""); err == nil {
+		t.Error("a missing log stream must be returned as an error")
+	}
+}
+
+func TestArchiveStreamRetriesLookup(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("/aws/lambda/api", &fakeStream{Name: "web-1", Events: events("first")})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	failures := 1
+	fake.handle("DescribeLogStreams", func(req fakeRequest) *fakeResponse {
+		if req.Input["logStreamNamePrefix"] == "web-1" && failures > 0 {
+			failures--
+			return logsError(http.StatusBadRequest, "ThrottlingException")
+		}
+		return nil
+	})
+
+	cfg := Config{"bucket": "archives", "target": "2024-06-01", "region": fakeRegion, "retry-base-delay": "1ms"}
+	if _, err := ArchiveStream(context.Background(), cfg, "/aws/lambda/api", "web-1"); err != nil {
+		t.Fatalf("a throttled lookup of the log stream must be retried: %v", err)
+	}
+	if failures > 0 {
+		t.Error("the lookup must have failed once")
+	}
+}
+
+func TestConcurrentRuns(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	fake.addStreams("staging", &fakeStream{Name: "web-2", Events: events("second")})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, env := range []string{"prod", "staging"} {
+		wg.Add(1)
+		go func(i int, env string) {
+			defer wg.Done()
+			_, errs[i] = ArchiveGroup(context.Background(), testConfig(Config{"environment": env}))
+		}(i, env)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatalf("concurrent runs must not clobber each other: %v", err)
+	}
+	for _, key := range []string{"/prod/2024-06-01.tar.gz", "/staging/2024-06-01.tar.gz"} {
+		if _, ok := fake.object("archives", key); !ok {
+			t.Errorf("the \"%s\" archive has not been uploaded", key)
+		}
+	}
+}
+
+func TestLambdaHandlerResetsFlags(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	configure(t, Config{"name-suffix": "rerun-2"})
+	setValue(t, &os.Args, handlerArgs())
+
+	summary, err := LambdaHandler(context.Background(), ScheduledEvent{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary.Key != "/prod/2024-06-01.tar.gz" {
+		t.Errorf("the options of a previous run must not leak into the handler, got %s", summary.Key)
+	}
+}
+
+func TestLambdaHandlerReturnsErrors(t *testing.T) {
+	useFakeAWS(t)
+	configure(t, nil)
+	flagSet.SetOutput(io.Discard)
+	t.Cleanup(func() { flagSet.SetOutput(nil) })
+
+	for _, args := range [][]string{{"-format", "zip"}, {"-unknown"}} {
+		setValue(t, &os.Args, handlerArgs(args...))
+		if _, err := LambdaHandler(context.Background(), ScheduledEvent{}); err == nil {
+			t.Errorf("%v must be returned as an error", args)
+		}
+	}
+
+	setValue(t, &os.Args, handlerArgs("-h"))
+	if code := RunCLI(); code != exitSuccess {
+		t.Errorf("the help of the CLI must not fail, got %d", code)
+	}
+}
+
+func TestDownloadLogsReturnsErrors(t *testing.T) {
+	useFakeAWS(t)
+	configure(t, nil)
+	prepareWorkspace()
+	setValue(t, &groupDirectory, "missing/")
+
+	err := downloadLogs(context.Background(), &cloudwatchlogs.LogStream{LogStreamName: aws.String("web-1")}, "web-1.log")
+	if err == nil {
+		t.Error("a workspace file which cannot be created must be returned as an error")
+	}
+}
+
+func TestTodayWindow(t *testing.T) {
+	configure(t, Config{"today": "true", "target": ""})
+
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !startDate.Equal(midnight) {
+		t.Errorf("the window must start at midnight, got %s", startDate)
+	}
+	if endDate.Before(startDate) || endDate.After(time.Now()) {
+		t.Errorf("the window must end now, got %s", endDate)
+	}
+	if name := archiveName(); name != midnight.Format("2006-01-02")+".partial.tar.gz" {
+		t.Errorf("the archive of the current day must be partial, got %s", name)
+	}
+}
+
+func TestTodayExcludesTarget(t *testing.T) {
+	configure(t, nil)
+
+	message := expectPanic(t, func() { loadConfig(testConfig(Config{"today": "true"})) })
+	if !strings.Contains(message, "cannot be used together") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestWindowIncludesLastMillisecond(t *testing.T) {
+	fake := useFakeAWS(t)
+	message, next := "last", "next day"
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: []fakeEvent{
+		{Timestamp: at("23:59:59.500"), Message: &message},
+		{Timestamp: at("00:00:00.000") + 24*3600*1000, Message: &next},
+	}})
+
+	_, entries := archiveEntries(t, fake, nil)
+	if content := entries["web-1.log"].content; content != "last\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+
+	input := fake.calls("GetLogEvents")[0].Input
+	if end := int64(input["endTime"].(float64)); end != at("00:00:00.000")+24*3600*1000 || at("23:59:59.500") >= end {
+		t.Errorf("the window must end at the next midnight (excluded), got %d", end)
+	}
+}
+
+func TestEmptyLogGroup(t *testing.T) {
+	fake := useFakeAWS(t)
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary.Uploaded || len(fake.calls("PutObject")) > 0 {
+		t.Error("nothing must be uploaded without any log stream")
+	}
+
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"upload-empty": "true"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fake.calls("PutObject")) != 1 {
+		t.Error("an empty archive must be uploaded with upload-empty")
+	}
+}
+
+func TestConcurrentWindows(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.pageSize = 7
+
+	var stream fakeStream
+	stream.Name = "web-1"
+	for i := 0; i < 96; i++ {
+		message := fmt.Sprintf("event %d", i)
+		timestamp := at("00:00:00.000") + int64(i)*15*60*1000
+		stream.Events = append(stream.Events, fakeEvent{Timestamp: timestamp, IngestionTime: timestamp, Message: &message})
+	}
+	fake.addStreams("prod", &stream)
+
+	_, sequential := archiveEntries(t, fake, nil)
+	_, concurrent := archiveEntries(t, fake, Config{"stream-parallelism": "4"})
+
+	if strings.Count(sequential["web-1.log"].content, "\n") != 96 {
+		t.Fatalf("unexpected sequential content: %q", sequential["web-1.log"].content)
+	}
+	if concurrent["web-1.log"].content != sequential["web-1.log"].content {
+		t.Errorf("concurrent windows must produce the sequential output, got %q", concurrent["web-1.log"].content)
+	}
+}
+
+func TestServicesAreReused(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	created := awsSession
+	archiveEntries(t, fake, nil)
+	archiveEntries(t, fake, nil)
+	if awsSession != created {
+		t.Error("the session must be reused across runs")
+	}
+
+	archiveEntries(t, fake, Config{"region": "eu-west-3"})
+	if awsSession == created || aws.StringValue(awsSession.Config.Region) != "eu-west-3" {
+		t.Error("the session must be created again when the region changes")
+	}
+
+	created = awsSession
+	resetServices()
+	loadServices()
+	if awsSession == created {
+		t.Error("the session must be created again once the services are reset")
+	}
+}
+
+func TestObjectACL(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	archiveEntries(t, fake, Config{"acl": "bucket-owner-full-control", "expected-bucket-owner": "123456789012"})
+
+	put := fake.calls("PutObject")[0]
+	if acl := put.Header.Get("X-Amz-Acl"); acl != "bucket-owner-full-control" {
+		t.Errorf("unexpected ACL: %q", acl)
+	}
+	if owner := put.Header.Get("X-Amz-Expected-Bucket-Owner"); owner != "123456789012" {
+		t.Errorf("unexpected bucket owner: %q", owner)
+	}
+}
+
+func TestMultipleBuckets(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	summary, _ := archiveEntries(t, fake, Config{"bucket": "archives,backup"})
+
+	if len(summary.Buckets) != 2 {
+		t.Fatalf("unexpected bucket results: %+v", summary.Buckets)
+	}
+	for _, destination := range []string{"archives", "backup"} {
+		if _, ok := fake.object(destination, summary.Key); !ok {
+			t.Errorf("the archive has not been uploaded to \"%s\"", destination)
+		}
+	}
+}
+
+func TestVerifyUpload(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	summary, _ := archiveEntries(t, fake, Config{"verify-upload": "true"})
+	if len(fake.calls("GetObject")) != 1 || len(summary.Buckets[0].Error) > 0 {
+		t.Errorf("the archive must be read back and verified: %+v", summary.Buckets)
+	}
+
+	fake.handle("GetObject", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: "corrupted"}
+	})
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"verify-upload": "true"}))
+	if err == nil || !strings.Contains(summary.Buckets[0].Error, "corrupted") {
+		t.Errorf("a mismatching archive must fail the upload: %v, %+v", err, summary.Buckets)
+	}
+
+	fake.handle("GetObject", func(req fakeRequest) *fakeResponse {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	summary, err = ArchiveGroup(context.Background(), testConfig(Config{"verify-upload": "true", "verify-timeout": "10ms"}))
+	if err == nil || !strings.Contains(summary.Buckets[0].Error, "verification") {
+		t.Errorf("the verification must be bounded by its own timeout: %v, %+v", err, summary.Buckets)
+	}
+}
+
+func TestEntryMode(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	_, entries := archiveEntries(t, fake, nil)
+	if mode := entries["web-1.log"].header.Mode; mode != 0600 && mode != 0644 {
+		t.Errorf("extracted files must be readable and not executable, got %o", mode)
+	}
+}
+
+func TestArchiveHoldsCompleteFiles(t *testing.T) {
+	fake := useFakeAWS(t)
+	messages := make([]string, 2000)
+	for i := range messages {
+		messages[i] = strings.Repeat("x", 100)
+	}
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events(messages...)})
+
+	_, entries := archiveEntries(t, fake, Config{"write-buffer-bytes": "65536"})
+	if size := len(entries["web-1.log"].content); size != 2000*101 {
+		t.Errorf("the entry must hold every event, got %d bytes", size)
+	}
+}
+
+func TestObjectExistsRetries(t *testing.T) {
+	fake := useFakeAWS(t)
+	configure(t, Config{"retry-base-delay": "1ms"})
+	fake.objects["archives/prod/2024-06-01.tar.gz"] = []byte("archive")
+
+	failures := 1
+	fake.handle("HeadObject", func(req fakeRequest) *fakeResponse {
+		if failures > 0 {
+			failures--
+			return s3Error(http.StatusServiceUnavailable, "SlowDown")
+		}
+		return nil
+	})
+	exists, err := objectExists(context.Background(), s3Service, "archives", "/prod/2024-06-01.tar.gz")
+	if err != nil || !exists {
+		t.Errorf("a 503 must be retried: %t, %v", exists, err)
+	}
+
+	calls := len(fake.calls("HeadObject"))
+	exists, err = objectExists(context.Background(), s3Service, "archives", "/prod/2024-06-02.tar.gz")
+	if err != nil || exists {
+		t.Errorf("a 404 means that the archive does not exist: %t, %v", exists, err)
+	}
+	if retried := len(fake.calls("HeadObject")) - calls; retried != 1 {
+		t.Errorf("a 404 must not be retried, %d calls", retried)
+	}
+}
+
+func TestProgressLogs(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ticks := make(chan time.Time)
+	setValue(t, &newTicker, func(time.Duration) (<-chan time.Time, func()) { return ticks, func() {} })
+	setValue(t, &progressInterval, time.Minute)
+
+	stop := reportProgress(&progress{streams: 1, events: 10, bytes: 100}, 2)
+	ticks <- time.Now()
+	stop()
+
+	if !strings.Contains(output.String(), "Progress: 1/2 streams downloaded, 10 events and 100 bytes written.") {
+		t.Errorf("progress must be logged periodically, got %q", output.String())
+	}
+}
+
+func TestInsightsQuery(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.handle("StartQuery", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{"queryId": "query"}}
+	})
+	fake.handle("GetQueryResults", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{
+			"status": "Complete",
+			"results": [][]map[string]string{
+				{{"field": "bin(1h)", "value": "2024-06-01 00:00:00.000"}, {"field": "count", "value": "3"}, {"field": "@ptr", "value": "ptr"}},
+				{{"field": "bin(1h)", "value": "2024-06-01 01:00:00.000"}, {"field": "count", "value": "5"}},
+			},
+		}}
+	})
+
+	summary, entries := archiveEntries(t, fake, Config{"insights-query": "stats count(*) by bin(1h)", "insights-format": "csv"})
+	if summary.Events != 2 {
+		t.Errorf("unexpected number of rows: %d", summary.Events)
+	}
+	expected := "bin(1h),count\n2024-06-01 00:00:00.000,3\n2024-06-01 01:00:00.000,5\n"
+	if content := entries["insights.csv"].content; content != expected {
+		t.Errorf("unexpected CSV results: %q", content)
+	}
+
+	_, entries = archiveEntries(t, fake, Config{"insights-query": "stats count(*) by bin(1h)"})
+	lines := strings.Split(strings.TrimSpace(entries["insights.json"].content), "\n")
+	var first map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || len(lines) != 2 {
+		t.Fatalf("unexpected JSON results: %q", entries["insights.json"].content)
+	}
+	if first["count"] != "3" || len(first) != 2 {
+		t.Errorf("unexpected JSON row: %v", first)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	archiveEntries(t, fake, Config{"insights-query": "stats count(*) by bin(1h)", "insights-limit": "2"})
+	if limit := fake.calls("StartQuery")[2].Input["limit"]; limit != float64(2) {
+		t.Errorf("the limit must be provided to the query, got %v", limit)
+	}
+	if !strings.Contains(output.String(), "some results may be missing") {
+		t.Errorf("results reaching the limit must be reported, got %q", output.String())
+	}
+}
+
+func TestInsightsQueryCanceled(t *testing.T) {
+	fake := useFakeAWS(t)
+	configure(t, Config{"insights-query": "stats count(*) by bin(1h)"})
+	fake.handle("StartQuery", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{"queryId": "query"}}
+	})
+	fake.handle("GetQueryResults", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{"status": "Running"}}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var waits []time.Duration
+	setValue(t, &after, func(wait time.Duration) <-chan time.Time {
+		waits = append(waits, wait)
+		cancel()
+		return make(chan time.Time)
+	})
+
+	if _, err := queryInsights(ctx); err != context.Canceled {
+		t.Errorf("a canceled query must be returned as an error, got %v", err)
+	}
+	if len(waits) != 1 || waits[0] != insightsPollInterval {
+		t.Errorf("unexpected waits between polls: %v", waits)
+	}
+	if stops := fake.calls("StopQuery"); len(stops) != 1 || stops[0].Input["queryId"] != "query" {
+		t.Errorf("a canceled query must be stopped: %+v", stops)
+	}
+}
+
+func TestStreamUpload(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first", "second")},
+		&fakeStream{Name: "web-2", Events: events("third")},
+	)
+
+	summary, entries := archiveEntries(t, fake, Config{"stream-upload": "true"})
+	if entries["web-1.log"].content != "first\nsecond\n" || entries["web-2.log"].content != "third\n" {
+		t.Errorf("unexpected archive content: %v", entries)
+	}
+
+	archive, _ := fake.object("archives", summary.Key)
+	if digest := sha256.Sum256(archive); summary.Checksum != hex.EncodeToString(digest[:]) {
+		t.Errorf("the checksum must be computed while streaming, got %s", summary.Checksum)
+	}
+
+	// Archives smaller than a part are uploaded with a single call.
+	for _, req := range append(fake.calls("PutObject"), fake.calls("UploadPart")...) {
+		if !req.Deadline.IsZero() {
+			t.Errorf("the upload must only be bounded by the deadline of the run, got %s", req.Deadline)
+		}
+	}
+}
+
+func TestReadFromTail(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.pageSize = 2
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("1", "2", "3", "4", "5")})
+
+	_, entries := archiveEntries(t, fake, nil)
+	if content := entries["web-1.log"].content; content != "1\n2\n3\n4\n5\n" {
+		t.Errorf("unexpected ascending content: %q", content)
+	}
+	for _, call := range fake.calls("GetLogEvents")[1:] {
+		if token, _ := call.Input["nextToken"].(string); !strings.HasPrefix(token, "f/") {
+			t.Errorf("forward tokens must be followed, got %q", token)
+		}
+	}
+
+	calls := len(fake.calls("GetLogEvents"))
+	_, entries = archiveEntries(t, fake, Config{"from-tail": "true"})
+	if content := entries["web-1.log"].content; content != "5\n4\n3\n2\n1\n" {
+		t.Errorf("unexpected descending content: %q", content)
+	}
+	for _, call := range fake.calls("GetLogEvents")[calls+1:] {
+		if token, _ := call.Input["nextToken"].(string); !strings.HasPrefix(token, "b/") {
+			t.Errorf("backward tokens must be followed, got %q", token)
+		}
+	}
+}
+
+func TestListArchives(t *testing.T) {
+	fake := useFakeAWS(t)
+	configure(t, Config{"list": "true"})
+	for _, day := range []string{"2024-05-29", "2024-05-30", "2024-05-31", "2024-06-01", "2024-06-02"} {
+		fake.objects["archives/prod/"+day+".tar.gz"] = []byte(day)
+	}
+
+	output := captureStdout(t, func() {
+		if err := listArchives(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	if len(fake.calls("ListObjectsV2")) != 3 {
+		t.Errorf("every page must be listed, %d calls", len(fake.calls("ListObjectsV2")))
+	}
+	for _, day := range []string{"2024-05-29", "2024-05-30", "2024-05-31", "2024-06-01", "2024-06-02"} {
+		if !strings.Contains(output, "prod/"+day+".tar.gz") {
+			t.Errorf("the archive of %s is not listed: %q", day, output)
+		}
+	}
+}
+
+// captureStdout returns what a function prints on the standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- string(content)
+	}()
+
+	fn()
+	writer.Close()
+
+	return <-output
+}
+
+func TestBinaryMessages(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("text", "nul\x00byte")})
+
+	summary, entries := archiveEntries(t, fake, Config{"encode-binary": "true"})
+	expected := "text\n" + binaryPrefix + base64.StdEncoding.EncodeToString([]byte("nul\x00byte")) + "\n"
+	if content := entries["web-1.log"].content; content != expected {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	if summary.Encoded != 1 {
+		t.Errorf("unexpected number of encoded messages: %d", summary.Encoded)
+	}
+}
+
+func TestLogGroupTemplate(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("/ecs/prod/api", &fakeStream{Name: "web-1", Events: events("first")})
+
+	summary, _ := archiveEntries(t, fake, Config{"log-group-template": "/ecs/{env}/api"})
+	if summary.LogGroup != "/ecs/prod/api" {
+		t.Errorf("unexpected log group: %s", summary.LogGroup)
+	}
+	if group := fake.calls("DescribeLogStreams")[0].Input["logGroupName"]; group != "/ecs/prod/api" {
+		t.Errorf("the rendered template must be described, got %v", group)
+	}
+}
+
+func TestArchiveGroupsByPrefix(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("/aws/lambda/api", &fakeStream{Name: "web-1", Events: events("api")})
+	fake.addStreams("/aws/lambda/worker", &fakeStream{Name: "web-1", Events: events("worker")})
+	fake.addStreams("/ecs/other", &fakeStream{Name: "web-1", Events: events("other")})
+	configure(t, Config{"environment": "", "log-group-prefix": "/aws/lambda/"})
+	setValue(t, &os.Args, handlerArgs("-environment", "", "-log-group-prefix", "/aws/lambda/"))
+
+	// Warm invocations parse the same arguments again, the flags being reset in between.
+	for run := 0; run < 2; run++ {
+		summary, err := LambdaHandler(context.Background(), ScheduledEvent{})
+		if err != nil {
+			t.Fatalf("run %d failed: %v", run, err)
+		}
+		if len(summary.Groups) != 2 {
+			t.Fatalf("unexpected groups: %+v", summary.Groups)
+		}
+	}
+
+	for group, key := range map[string]string{"api": "aws_lambda_api", "worker": "aws_lambda_worker"} {
+		archive, ok := fake.object("archives", key+"/2024-06-01.tar.gz")
+		if !ok {
+			t.Fatalf("the archive of the %s group has not been uploaded", group)
+		}
+		if content := readTarGz(t, archive)["web-1.log"].content; content != group+"\n" {
+			t.Errorf("unexpected content for the %s group: %q", group, content)
+		}
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	summary, _ := archiveEntries(t, fake, Config{"write-checksum-file": "true"})
+
+	archive, _ := fake.object("archives", summary.Key)
+	digest := sha256.Sum256(archive)
+	sidecar, ok := fake.object("archives", summary.Key+".sha256")
+	if !ok {
+		t.Fatal("the checksum file has not been uploaded")
+	}
+	if expected := hex.EncodeToString(digest[:]) + "  2024-06-01.tar.gz\n"; string(sidecar) != expected {
+		t.Errorf("unexpected checksum file: %q", sidecar)
+	}
+	if summary.Checksum != hex.EncodeToString(digest[:]) {
+		t.Errorf("unexpected checksum in the summary: %s", summary.Checksum)
+	}
+}
+
+func TestInterruptedCLIRemovesWorkspace(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	configure(t, nil)
+	setValue(t, &os.Args, handlerArgs())
+
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+
+	captureStdout(t, func() {
+		if code := RunCLI(); code == exitSuccess {
+			t.Error("an interrupted run must not succeed")
+		}
+	})
+	if _, err := os.Stat(workspace); !os.IsNotExist(err) {
+		t.Errorf("the workspace must be removed, got %v", err)
+	}
+	if len(fake.calls("PutObject")) > 0 {
+		t.Error("an interrupted run must not upload anything")
+	}
+}
+
+func TestCollidingStreamNames(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "app/1", Events: events("slash")},
+		&fakeStream{Name: "app_1", Events: events("underscore")},
+	)
+
+	_, entries := archiveEntries(t, fake, nil)
+
+	contents := make(map[string]string)
+	for name, entry := range entries {
+		if !strings.HasPrefix(name, "app_1-") || !strings.HasSuffix(name, ".log") {
+			t.Errorf("colliding streams must be disambiguated, got %s", name)
+		}
+		contents[entry.content] = name
+	}
+	if len(entries) != 2 || len(contents["slash\n"]) == 0 || len(contents["underscore\n"]) == 0 {
+		t.Errorf("each stream must get its own entry: %v", entries)
+	}
+	if stream := entries[contents["slash\n"]].header.PAXRecords[streamPAXRecord]; stream != "app/1" {
+		t.Errorf("the original stream name must be kept, got %q", stream)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events(strings.Split(strings.Repeat("message ", 2000), " ")...)})
+	configure(t, nil)
+	setValue(t, &stats, new(progress))
+
+	writes := func(size int) int {
+		setValue(t, &streamBufferBytes, size)
+		output := &countingWriter{}
+		logStream := &cloudwatchlogs.LogStream{LogStreamName: aws.String("web-1")}
+		if err := fetchEvents(context.Background(), output, logStream, timeWindow{startDate, endDate}, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return output.writes
+	}
+
+	if small, large := writes(minWriteBufferBytes), writes(256*1024); large >= small {
+		t.Errorf("a larger buffer must perform fewer writes (%d with the smaller one, %d with the larger one)", small, large)
+	}
+}
+
+// countingWriter counts the writes it receives.
+type countingWriter struct {
+	writes int
+}
+
+// Write counts a write, discarding its bytes.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func TestStaleFilesAreCleared(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	if err := os.MkdirAll(workspace, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(workspace+"/stale.log", []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries := archiveEntries(t, fake, nil)
+	if _, ok := entries["stale.log"]; ok || len(entries) != 1 {
+		t.Errorf("stale files must not be archived: %v", entries)
+	}
+}
+
+func TestWorkspaceLock(t *testing.T) {
+	t.Cleanup(func() { os.Remove(workspaceLock) })
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+
+	cases := []struct {
+		name   string
+		lock   string
+		locked bool
+	}{
+		{"running owner", fmt.Sprintf("%d %d\n", os.Getppid(), future), true},
+		{"running owner without deadline", fmt.Sprintf("%d 0\n", os.Getppid()), true},
+		{"deadline passed", fmt.Sprintf("%d %d\n", os.Getppid(), past), false},
+		{"owner gone", fmt.Sprintf("%d %d\n", 1<<22, future), false},
+		{"current process", fmt.Sprintf("%d %d\n", os.Getpid(), future), false},
+		{"unreadable", "corrupted", false},
+	}
+	for _, c := range cases {
+		if err := os.WriteFile(workspaceLock, []byte(c.lock), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := lockWorkspace(context.Background())
+		if locked := err != nil; locked != c.locked {
+			t.Errorf("%s: unexpected lock error: %v", c.name, err)
+		}
+		os.Remove(workspaceLock)
+	}
+
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Unix(future, 0))
+	defer cancelFn()
+	if err := lockWorkspace(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, _ := os.ReadFile(workspaceLock)
+	if expected := fmt.Sprintf("%d %d\n", os.Getpid(), future); string(content) != expected {
+		t.Errorf("the lock must hold the PID and the deadline of its owner, got %q", content)
+	}
+}
+
+func TestNamedStreams(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-10", Events: events("tenth")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+
+	_, entries := archiveEntries(t, fake, Config{"streams": "web-1"})
+	if len(entries) != 1 || entries["web-1.log"].content != "first\n" {
+		t.Errorf("only the named stream must be archived: %v", entries)
+	}
+	for _, call := range fake.calls("GetLogEvents") {
+		if call.Input["logStreamName"] != "web-1" {
+			t.Errorf("the \"%s\" stream must not be downloaded", call.Input["logStreamName"])
+		}
+	}
+
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"streams": "web-1,web-3"}))
+	if err == nil || !strings.Contains(err.Error(), "\"web-3\" log stream does not exist") {
+		t.Errorf("an unknown stream must fail the run, got %v", err)
+	}
+}
+
+func TestIngestionTime(t *testing.T) {
+	fake := useFakeAWS(t)
+	message := "first"
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: []fakeEvent{
+		{Timestamp: at("13:04:05.250"), IngestionTime: at("13:04:07.500"), Message: &message},
+	}})
+
+	_, entries := archiveEntries(t, fake, Config{"include-timestamps": "true", "include-ingestion-time": "true", "field-delimiter": "|"})
+	if content := entries["web-1.log"].content; content != "2024-06-01T13:04:05.250Z|2024-06-01T13:04:07.500Z|first\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestParallelGzip(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	// The archive is read back with the gzip package of the standard library.
+	_, entries := archiveEntries(t, fake, Config{"parallel-gzip": "true"})
+	if content := entries["web-1.log"].content; content != "first\nsecond\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	setValue(t, &quiet, true)
+	logInfo("information")
+	log.Println("error")
+
+	if strings.Contains(output.String(), "information") || !strings.Contains(output.String(), "error") {
+		t.Errorf("only errors must be logged, got %q", output.String())
+	}
+
+	// The notices about the options are informational as well.
+	configure(t, Config{"quiet": "true", "describe-limit": "1000", "include-ingestion-time": "true"})
+	if strings.Contains(output.String(), "capped") || strings.Contains(output.String(), "ignored") {
+		t.Errorf("the notices about the options must not be logged, got %q", output.String())
+	}
+}
+
+func TestRetriesAreNotCompounded(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	cfg := testConfig(Config{"max-retries": "2", "retry-base-delay": "1ms", "retry-max-delay": "1ms"})
+
+	fake.handle("DescribeLogStreams", func(req fakeRequest) *fakeResponse {
+		return logsError(http.StatusServiceUnavailable, "ServiceUnavailableException")
+	})
+	if _, err := ArchiveGroup(context.Background(), cfg); err == nil {
+		t.Error("a call failing on every attempt must fail the run")
+	}
+	if calls := len(fake.calls("DescribeLogStreams")); calls != 3 {
+		t.Errorf("a CloudWatch call must be attempted max-retries + 1 times, got %d calls", calls)
+	}
+
+	fake.handle("DescribeLogStreams", nil)
+	failures := 1
+	fake.handle("PutObject", func(req fakeRequest) *fakeResponse {
+		if failures > 0 {
+			failures--
+			return s3Error(http.StatusServiceUnavailable, "SlowDown")
+		}
+		return nil
+	})
+	if summary, err := ArchiveGroup(context.Background(), cfg); err != nil || !summary.Uploaded {
+		t.Errorf("a failed upload must be retried: %+v (error: %v)", summary, err)
+	}
+}
+
+func TestDescribeRetriesPages(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+		&fakeStream{Name: "web-3", Events: events("third")},
+	)
+
+	failures := 1
+	fake.handle("DescribeLogStreams", func(req fakeRequest) *fakeResponse {
+		if req.Input["nextToken"] == "1" && failures > 0 {
+			failures--
+			return logsError(http.StatusBadRequest, "ThrottlingException")
+		}
+		return nil
+	})
+
+	summary, entries := archiveEntries(t, fake, Config{"describe-limit": "1", "retry-base-delay": "1ms"})
+	if summary.Streams != 3 || len(entries) != 3 {
+		t.Errorf("every stream must be collected: %+v", summary)
+	}
+	if failures > 0 {
+		t.Error("the second page must have failed once")
+	}
+}
+
+func TestParseAccessPoint(t *testing.T) {
+	if accessPoint, err := parseAccessPoint("archives"); accessPoint != nil || err != nil {
+		t.Errorf("a plain bucket name is not an access point, got %v and %v", accessPoint, err)
+	}
+
+	accessPoint, err := parseAccessPoint("arn:aws:s3:eu-west-3:123456789012:accesspoint/archives")
+	if err != nil || accessPoint.Region != "eu-west-3" || accessPoint.AccountID != "123456789012" {
+		t.Errorf("unexpected access point %v (error: %v)", accessPoint, err)
+	}
+	if region, err := bucketRegion(context.Background(), accessPoint.String()); region != "eu-west-3" || err != nil {
+		t.Errorf("the region of an access point must be read from its ARN, got %q (error: %v)", region, err)
+	}
+
+	if _, err := parseAccessPoint("arn:aws:s3:::archives"); err == nil {
+		t.Error("a bucket ARN without region is not a valid access point")
+	}
+}
+
+func TestMinimumAge(t *testing.T) {
+	configure(t, nil)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+
+	message := expectPanic(t, func() { loadConfig(testConfig(Config{"target": yesterday, "min-age-hours": "48"})) })
+	if !strings.Contains(message, "refusing to archive logs ending on") {
+		t.Errorf("a recent day must be refused, got %q", message)
+	}
+
+	loadConfig(testConfig(Config{"target": yesterday, "min-age-hours": "48", "force": "true"}))
+	if startDate.Format("2006-01-02") != yesterday {
+		t.Errorf("the force flag must bypass the minimum age, got %s", startDate)
+	}
+}
+
+func TestNoTar(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	summary, archive := uploadedArchive(t, fake, Config{"no-tar": "true"})
+	if summary.Key != "/prod/2024-06-01.log.gz" {
+		t.Errorf("unexpected archive key: %s", summary.Key)
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(gr); err != nil || string(content) != "first\nsecond\n" {
+		t.Errorf("unexpected archive content: %q (error: %v)", content, err)
+	}
+}
+
+// uploadedArchive runs an archiving process and returns the uploaded archive.
+func uploadedArchive(t *testing.T, fake *fakeAWS, cfg Config) (RunSummary, []byte) {
+	t.Helper()
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(cfg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	archive, ok := fake.object(summary.Buckets[0].Bucket, summary.Key)
+	if !ok {
+		t.Fatalf("the \"%s\" archive has not been uploaded", summary.Key)
+	}
+
+	return summary, archive
+}
+
+func TestMergeStreams(t *testing.T) {
+	fake := useFakeAWS(t)
+	first, second, third := "first", "second", "third"
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: []fakeEvent{{Timestamp: at("00:00:01.000"), Message: &first}, {Timestamp: at("00:00:03.000"), Message: &third}}},
+		&fakeStream{Name: "web-2", Events: []fakeEvent{{Timestamp: at("00:00:02.000"), Message: &second}}},
+	)
+
+	_, entries := archiveEntries(t, fake, Config{"merge": "true", "merge-prefix": "true"})
+	if len(entries) != 1 {
+		t.Errorf("the streams must be merged into a single file: %v", entries)
+	}
+	if content := entries["merged.log"].content; content != "[web-1] first\n[web-2] second\n[web-1] third\n" {
+		t.Errorf("unexpected merged content: %q", content)
+	}
+}
+
+func TestDateFormat(t *testing.T) {
+	configure(t, Config{"date-format": "20060102"})
+	if name := archiveName(); name != "20240601.tar.gz" {
+		t.Errorf("unexpected archive name: %s", name)
+	}
+
+	configure(t, Config{"date-format": "2006/01/02"})
+	if key := archiveKey(archiveName()); key != "/prod/2024/06/01.tar.gz" {
+		t.Errorf("unexpected archive key: %s", key)
+	}
+
+	message := expectPanic(t, func() { loadConfig(testConfig(Config{"date-format": "2006-01-02T15"})) })
+	if !strings.Contains(message, "must not depend on the time of day") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestPerFileGzip(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "0-early", Events: events("early", "again")},
+		&fakeStream{Name: "web-1", Events: events("first", "second")},
+	)
+
+	_, plain := archiveEntries(t, fake, nil)
+	_, compressed := archiveEntries(t, fake, Config{"per-file-gzip": "true"})
+	if len(compressed) != len(plain) {
+		t.Fatalf("unexpected entries: %v", compressed)
+	}
+	for name, entry := range plain {
+		if content := gunzip(t, []byte(compressed[name+".gz"].content)); content != entry.content {
+			t.Errorf("unexpected content for %s: %q instead of %q", name, content, entry.content)
+		}
+	}
+}
+
+func TestPerFileGzipWithoutTar(t *testing.T) {
+	fake := useFakeAWS(t)
+	// The stream sorts before the staged archive, which must not be appended to itself.
+	fake.addStreams("prod", &fakeStream{Name: "0-early", Events: events("early", "again")})
+
+	_, twoPass := uploadedArchive(t, fake, Config{"no-tar": "true"})
+	_, streamed := uploadedArchive(t, fake, Config{"no-tar": "true", "per-file-gzip": "true"})
+	if content := gunzip(t, streamed); content != gunzip(t, twoPass) || content != "early\nagain\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+// gunzip decompresses every member of a gzip file.
+func gunzip(t *testing.T, content []byte) string {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to read the gzip file: %v", err)
+	}
+	decompressed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("failed to decompress the gzip file: %v", err)
+	}
+	return string(decompressed)
+}
+
+func TestGroupKeyPrefix(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("/aws/lambda/api", &fakeStream{Name: "web-1", Events: events("api")})
+	fake.addStreams("/aws/lambda/api-v2", &fakeStream{Name: "web-1", Events: events("api v2")})
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"environment": "", "log-group-prefix": "/aws/lambda/"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := make(map[string]bool)
+	for _, group := range summary.Groups {
+		keys[group.Key] = true
+	}
+	if !keys["/aws_lambda_api/2024-06-01.tar.gz"] || !keys["/aws_lambda_api-v2/2024-06-01.tar.gz"] {
+		t.Errorf("each group must be archived under its own key: %v", keys)
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	setValue(t, &profile, "backfill")
+	setValue(t, &region, "eu-west-3")
+	setValue(t, &awsHTTPClient, nil)
+
+	options := sessionOptions()
+	if options.Profile != "backfill" || options.SharedConfigState != session.SharedConfigEnable {
+		t.Errorf("the profile must be read from the shared configuration: %+v", options)
+	}
+	if aws.StringValue(options.Config.Region) != "eu-west-3" {
+		t.Errorf("unexpected region: %v", options.Config.Region)
+	}
+	if options.Config.MaxRetries == nil || *options.Config.MaxRetries != 0 {
+		t.Errorf("calls retried by the process must not be retried by the SDK: %v", options.Config.MaxRetries)
+	}
+
+	setValue(t, &profile, "")
+	setValue(t, &region, "")
+	if options = sessionOptions(); len(options.Profile) > 0 || options.Config.Region != nil {
+		t.Errorf("the default credential chain must be used without profile: %+v", options)
+	}
+}
+
+func TestTarPrefix(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	_, entries := archiveEntries(t, fake, Config{"tar-prefix": "logs/{env}/{date}"})
+	if content := entries["logs/prod/2024-06-01/web-1.log"].content; content != "first\n" {
+		t.Errorf("the entries must be stored under the prefix: %v", entries)
+	}
+	for _, directory := range []string{"logs/", "logs/prod/", "logs/prod/2024-06-01/"} {
+		if entry, ok := entries[directory]; !ok || entry.header.Typeflag != tar.TypeDir {
+			t.Errorf("the \"%s\" directory entry is missing", directory)
+		}
+	}
+}
+
+func TestMaxTotalBytes(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events(strings.Repeat("x", 64*1024), strings.Repeat("y", 64*1024))})
+
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"max-total-bytes": "1024", "format": "none"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum size of 1024 bytes") {
+		t.Errorf("a runaway archive must be aborted, got %v", err)
+	}
+	if len(fake.calls("PutObject")) > 0 || len(fake.calls("CreateMultipartUpload")) > 0 {
+		t.Error("an aborted archive must not be uploaded")
+	}
+}
+
+func TestHivePartitions(t *testing.T) {
+	configure(t, Config{"partition-style": "hive"})
+	if key := archiveKey(archiveName()); key != "/prod/year=2024/month=06/day=01/2024-06-01.tar.gz" {
+		t.Errorf("unexpected archive key: %s", key)
+	}
+}
+
+func TestAPITimeoutIsRetried(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	blocked := 1
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		fake.mutex.Lock()
+		block := blocked > 0
+		blocked--
+		fake.mutex.Unlock()
+		if block {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return nil
+	})
+
+	_, entries := archiveEntries(t, fake, Config{"api-timeout": "100ms", "retry-base-delay": "1ms"})
+	if content := entries["web-1.log"].content; content != "first\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	// The retried call repeats the first request, the stream being read until its token no longer changes.
+	calls := fake.calls("GetLogEvents")
+	if len(calls) < 2 || !bytes.Equal(calls[0].Body, calls[1].Body) {
+		t.Errorf("the timed out call must be retried, got %d calls", len(calls))
+	}
+}
+
+func TestKeepEmpty(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2"},
+	)
+
+	if _, entries := archiveEntries(t, fake, nil); len(entries) != 1 {
+		t.Errorf("empty streams must be skipped by default: %v", entries)
+	}
+
+	_, entries := archiveEntries(t, fake, Config{"keep-empty": "true"})
+	if entry, ok := entries["web-2.log"]; !ok || entry.header.Size != 0 {
+		t.Errorf("empty streams must be kept as zero-byte entries: %v", entries)
+	}
+}
+
+func TestMultistreamGzip(t *testing.T) {
+	directory := t.TempDir()
+	for i, content := range []string{"first\n", "second\n"} {
+		var member bytes.Buffer
+		gw := gzip.NewWriter(&member)
+		gw.Write([]byte(content))
+		gw.Close()
+		if err := os.WriteFile(fmt.Sprintf("%s/web-%d.log.gz", directory, i), member.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setValue(t, &noTar, true)
+	setValue(t, &perFileGzip, true)
+
+	var archive bytes.Buffer
+	err := archiveFiles(&archive, "2024-06-01.log.gz", func(fn func(path string, info os.FileInfo) error) error {
+		for i := 0; i < 2; i++ {
+			if err := fn(fmt.Sprintf("%s/web-%d.log.gz", directory, i), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if content := gunzip(t, archive.Bytes()); content != "first\nsecond\n" {
+		t.Errorf("both members must be read back as a single stream, got %q", content)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	file := t.TempDir() + "/config.json"
+	content := `{"environment": "staging", "streams": ["web-1", "web-2"], "describe-limit": 10, "keep-empty": true}`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("KEEP_EMPTY", "false")
+	options := testConfig(Config{"config": file})
+	delete(options, "environment")
+	configure(t, Config{"environment": "prod"})
+	loadConfig(options)
+	if environment != "staging" || streamNameList != "web-1,web-2" || describeLimit != 10 {
+		t.Errorf("the values of the file must be applied: %s, %s, %d", environment, streamNameList, describeLimit)
+	}
+	if keepEmpty {
+		t.Error("environment variables must take precedence over the file")
+	}
+
+	configure(t, Config{"config": file, "environment": "prod"})
+	if environment != "prod" {
+		t.Errorf("flags must take precedence over the file, got %s", environment)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"unknown": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if message := expectPanic(t, func() { loadConfig(testConfig(Config{"config": file})) }); !strings.Contains(message, "unknown key") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	failed := errors.New("failed")
+	succeeded := []BucketResult{{Bucket: "archives"}}
+
+	for _, test := range []struct {
+		name    string
+		summary RunSummary
+		err     error
+		code    int
+	}{
+		{"success", RunSummary{Streams: 1, Buckets: succeeded}, nil, exitSuccess},
+		{"failure", RunSummary{}, failed, exitFailure},
+		{"failed bucket", RunSummary{Streams: 1, Buckets: []BucketResult{{Bucket: "archives"}, {Bucket: "backup", Error: "denied"}}}, failed, exitPartial},
+		{"failed stream", RunSummary{Streams: 2, FailedStreams: []string{"web-2"}, Buckets: succeeded}, failed, exitPartial},
+		{"failed group", RunSummary{Groups: []RunSummary{{Streams: 1, Buckets: succeeded}, {Error: "failed"}}}, failed, exitPartial},
+	} {
+		if code := exitCode(test.summary, test.err); code != test.code {
+			t.Errorf("%s: unexpected exit code %d instead of %d", test.name, code, test.code)
+		}
+	}
+}
+
+func TestDryRunEstimate(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first"), StoredBytes: 1000},
+		&fakeStream{Name: "web-2", Events: events("second"), StoredBytes: 2500},
+	)
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"dry-run": "true"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary.Streams != 2 || summary.EstimatedBytes != 3500 {
+		t.Errorf("unexpected estimate: %+v", summary)
+	}
+	if len(fake.calls("GetLogEvents")) > 0 || len(fake.calls("PutObject")) > 0 {
+		t.Error("a dry run must neither download nor upload")
+	}
+}
+
+func TestPresignedURL(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	var received []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			received, _ = io.ReadAll(r.Body)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, "denied")
+	}))
+	defer server.Close()
+
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"bucket": "", "presigned-url": server.URL + "/upload?X-Amz-Signature=secret"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readTarGz(t, received)["web-1.log"].content; content != "first\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	if len(fake.calls("PutObject")) > 0 {
+		t.Error("the archive must not be uploaded to S3")
+	}
+
+	status = http.StatusForbidden
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"bucket": "", "presigned-url": server.URL + "/upload?X-Amz-Signature=secret"}))
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden: denied") {
+		t.Errorf("the failed upload must be reported, got %v", err)
+	}
+}
+
+func TestObjectMetadata(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	archiveEntries(t, fake, Config{"metadata": "team=platform, cost-center=42"})
+
+	header := fake.calls("PutObject")[0].Header
+	for key, value := range map[string]string{"team": "platform", "cost-center": "42", "environment": "prod", "target-date": "2024-06-01", "event-count": "2"} {
+		if actual := header.Get("X-Amz-Meta-" + key); actual != value {
+			t.Errorf("unexpected value for the \"%s\" metadata: %q", key, actual)
+		}
+	}
+
+	if message := expectPanic(t, func() { loadConfig(testConfig(Config{"metadata": "environment=dev"})) }); !strings.Contains(message, "reserved") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestInvalidParameterSkipsStream(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if req.Input["logStreamName"] == "web-2" {
+			return logsError(http.StatusBadRequest, "InvalidParameterException")
+		}
+		return nil
+	})
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(nil))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || !strings.Contains(err.Error(), "InvalidParameterException") {
+		t.Errorf("the failed stream must be reported, got %v", err)
+	}
+	if len(summary.FailedStreams) != 1 || summary.FailedStreams[0] != "web-2" {
+		t.Errorf("the stream must be marked as failed: %v", summary.FailedStreams)
+	}
+	if !strings.Contains(output.String(), "\"web-2\" log stream has been rejected by CloudWatch") {
+		t.Errorf("a warning must be logged for the rejected stream, got %q", output.String())
+	}
+
+	archive, _ := fake.object("archives", summary.Key)
+	if entries := readTarGz(t, archive); len(entries) != 1 || entries["web-1.log"].content != "first\n" {
+		t.Errorf("the other streams must be archived: %v", entries)
+	}
+}
+
+func TestInactiveStreamsAreSkipped(t *testing.T) {
+	fake := useFakeAWS(t)
+	old := "previous day"
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: []fakeEvent{{Timestamp: at("12:00:00.000") - 24*3600*1000, IngestionTime: at("12:00:00.000") - 24*3600*1000, Message: &old}}},
+		&fakeStream{Name: "web-3"},
+	)
+
+	_, entries := archiveEntries(t, fake, nil)
+	if len(entries) != 1 {
+		t.Errorf("only the active stream must be archived: %v", entries)
+	}
+	for _, call := range fake.calls("GetLogEvents") {
+		if call.Input["logStreamName"] != "web-1" {
+			t.Errorf("the dormant \"%s\" stream must not be downloaded", call.Input["logStreamName"])
+		}
+	}
+}
+
+func TestSplitThreshold(t *testing.T) {
+	fake := useFakeAWS(t)
+	var messages []string
+	for i := 0; i < 30; i++ {
+		messages = append(messages, fmt.Sprintf("event %d", i))
+	}
+	stream := &fakeStream{Name: "web-1", Events: events(messages...)}
+	// Events are spread over several hours of the day.
+	for i := range stream.Events {
+		stream.Events[i].Timestamp += int64(i) * 3600 * 1000 / 2
+		stream.Events[i].IngestionTime += int64(i) * 3600 * 1000 / 2
+	}
+	fake.addStreams("prod", stream)
+	fake.pageSize = 4
+
+	summary, whole := archiveEntries(t, fake, nil)
+	split, hourly := archiveEntries(t, fake, Config{"split-threshold": "10"})
+
+	if split.Events != 30 || summary.Events != split.Events || hourly["web-1.log"].content != whole["web-1.log"].content {
+		t.Errorf("the split download must produce the same events (%d instead of %d)", split.Events, summary.Events)
+	}
+	if len(fake.calls("GetLogEvents")) <= 2*8 {
+		t.Error("the stream must have been downloaded hour by hour")
+	}
+}
+
+func TestLineTerminator(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	for terminator, content := range map[string]string{"lf": "first\nsecond\n", "crlf": "first\r\nsecond\r\n", `\x1e`: "first\x1esecond\x1e"} {
+		_, entries := archiveEntries(t, fake, Config{"line-terminator": terminator})
+		if actual := entries["web-1.log"].content; actual != content {
+			t.Errorf("unexpected content with the %s terminator: %q", terminator, actual)
+		}
+	}
+}
+
+func TestKeepWorkspace(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	archiveEntries(t, fake, Config{"keep-workspace": "true"})
+	if _, err := os.Stat(workspace + "/web-1.log"); err != nil {
+		t.Errorf("the workspace must be kept: %v", err)
+	}
+
+	archiveEntries(t, fake, Config{"clean": "true"})
+	if _, err := os.Stat(workspace); !os.IsNotExist(err) {
+		t.Errorf("the workspace must be removed: %v", err)
+	}
+}
+
+func TestBzip2(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	summary, archive := uploadedArchive(t, fake, Config{"format": "bzip2"})
+	if !strings.HasSuffix(summary.Key, ".tar.bz2") {
+		t.Errorf("unexpected archive key: %s", summary.Key)
+	}
+
+	br, err := bzip2.NewReader(bytes.NewReader(archive), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readTar(t, br)["web-1.log"].content; content != "first\nsecond\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestFailedStreamsAreReturned(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+		&fakeStream{Name: "web-3", Events: events("third")},
+	)
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if req.Input["logStreamName"] != "web-1" {
+			return logsError(http.StatusBadRequest, "AccessDeniedException")
+		}
+		return nil
+	})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(nil))
+	if err == nil || !strings.Contains(err.Error(), "\"web-2\" log stream") || !strings.Contains(err.Error(), "\"web-3\" log stream") {
+		t.Errorf("the error must list every failed stream, got %v", err)
+	}
+	if !summary.Uploaded || len(summary.FailedStreams) != 2 {
+		t.Errorf("the successful streams must still be archived: %+v", summary)
+	}
+	archive, _ := fake.object("archives", summary.Key)
+	if entries := readTarGz(t, archive); len(entries) != 1 || entries["web-1.log"].content != "first\n" {
+		t.Errorf("unexpected archive content: %v", entries)
+	}
+}
+
+func TestFailOnPartial(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if req.Input["logStreamName"] == "web-2" {
+			return logsError(http.StatusBadRequest, "AccessDeniedException")
+		}
+		return nil
+	})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"fail-on-partial": "true"})); err == nil {
+		t.Error("the run must fail with the fail-on-partial flag")
+	}
+	if len(fake.calls("PutObject")) > 0 {
+		t.Error("nothing must be archived with the fail-on-partial flag")
+	}
+}
+
+func TestAllStreamsFailed(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		return logsError(http.StatusBadRequest, "AccessDeniedException")
+	})
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(nil))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || summary.Uploaded {
+		t.Errorf("a run whose streams all failed must fail, got %v", err)
+	}
+	if len(fake.calls("PutObject")) > 0 {
+		t.Error("an empty archive must not be uploaded")
+	}
+}
+
+func TestDeadlineUploadsPartialArchive(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if req.Input["logStreamName"] == "web-2" {
+			time.Sleep(time.Second)
+		}
+		return nil
+	})
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	summary, err := ArchiveGroup(ctx, testConfig(Config{"safety-margin": "4700ms"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !summary.Truncated || summary.Key != "/prod/2024-06-01.partial.tar.gz" {
+		t.Errorf("the archive must be marked as partial: %+v", summary)
+	}
+	archive, _ := fake.object("archives", summary.Key)
+	if entries := readTarGz(t, archive); entries["web-1.log"].content != "first\n" {
+		t.Errorf("the logs downloaded before the deadline must be archived: %v", entries)
+	}
+}
+
+func TestSafetyMarginBeyondDeadline(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	summary, err := ArchiveGroup(ctx, testConfig(Config{"safety-margin": "10s"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || !strings.Contains(err.Error(), "safety margin") {
+		t.Errorf("a safety margin beyond the deadline must fail, got %v", err)
+	}
+	if summary.Uploaded || len(summary.FailedStreams) != 2 || len(summary.StreamResults) != 2 || len(summary.StreamResults[0].Error) == 0 {
+		t.Errorf("every stream must be reported as failed: %+v", summary)
+	}
+	if len(fake.calls("GetLogEvents")) > 0 || len(fake.calls("PutObject")) > 0 {
+		t.Error("nothing must be downloaded nor uploaded when the safety margin exceeds the time left")
+	}
+}
+
+func TestJQProjection(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events(
+		`{"level": "info", "msg": "started", "request": {"id": 1}}`,
+		"not JSON",
+	)})
+
+	_, entries := archiveEntries(t, fake, Config{"jq": "{level, msg}"})
+	if content := entries["web-1.log"].content; content != "{\"level\":\"info\",\"msg\":\"started\"}\nnot JSON\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+
+	_, entries = archiveEntries(t, fake, Config{"jq": "{level, msg}", "jq-drop-invalid": "true"})
+	if content := entries["web-1.log"].content; content != "{\"level\":\"info\",\"msg\":\"started\"}\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestDropPatterns(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("GET /health 200", "GET /users 200", "GET /ready 200")})
+
+	summary, entries := archiveEntries(t, fake, Config{"drop-pattern": "/health ,/ready "})
+	if content := entries["web-1.log"].content; content != "GET /users 200\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	if summary.Dropped != 2 {
+		t.Errorf("the dropped messages must be counted: %+v", summary)
+	}
+}
+
+func TestRedactRules(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("user=alice password=secret token=abc", "password=other")})
+
+	summary, entries := archiveEntries(t, fake, Config{"redact": `password=\w+=[REDACTED],token=\w+=[REDACTED]`})
+	if content := entries["web-1.log"].content; content != "user=alice [REDACTED] [REDACTED]\n[REDACTED]\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	if summary.Redacted != 3 {
+		t.Errorf("unexpected number of redactions: %d", summary.Redacted)
+	}
+}
+
+func TestRedactMessageKeepsContext(t *testing.T) {
+	configure(t, Config{"redact": `\Bkey=[KEY],(\w+)@example\.com=$1@[DOMAIN]`})
+
+	var counters progress
+	if message := redactMessage("monkey key alice@example.com", &counters); message != "mon[KEY] key alice@[DOMAIN]" {
+		t.Errorf("patterns must be matched against the whole message, got %q", message)
+	}
+	if counters.redacted != 2 {
+		t.Errorf("unexpected number of redactions: %d", counters.redacted)
+	}
+}
+
+func TestGCSDestinationRequiresTag(t *testing.T) {
+	if supportsGCS {
+		t.Skip("the binary is built with the gcs tag")
+	}
+	configure(t, nil)
+
+	message := expectPanic(t, func() { loadConfig(testConfig(Config{"destination": "gcs"})) })
+	if !strings.Contains(message, "gcs tag") {
+		t.Errorf("the gcs destination requires the gcs tag, got %s", message)
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	fake.objects["archives/prod/2024-06-01.tar.gz"] = []byte("previous")
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"overwrite": "false"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || !strings.Contains(summary.Buckets[0].Error, "already exists") {
+		t.Errorf("an existing archive must not be overwritten, got %v", summary.Buckets)
+	}
+	if archive, _ := fake.object("archives", "prod/2024-06-01.tar.gz"); string(archive) != "previous" {
+		t.Error("the existing archive must be kept")
+	}
+
+	if _, entries := archiveEntries(t, fake, nil); entries["web-1.log"].content != "first\n" {
+		t.Errorf("the archive must be overwritten by default: %v", entries)
+	}
+}
+
+func TestDuplicateStreams(t *testing.T) {
+	fake := useFakeAWS(t)
+	stream := &fakeStream{Name: "web-1", Events: events("first")}
+	fake.addStreams("prod", stream, &fakeStream{Name: "web-2", Events: events("second")}, stream)
+
+	summary, entries := archiveEntries(t, fake, Config{"describe-limit": "1"})
+	if summary.Streams != 2 || entries["web-1.log"].content != "first\n" {
+		t.Errorf("the duplicate stream must be archived once: %+v", summary)
+	}
+
+	downloads := make(map[interface{}]int)
+	for _, call := range fake.calls("GetLogEvents") {
+		downloads[call.Input["logStreamName"]]++
+	}
+	if downloads["web-1"] != downloads["web-2"] {
+		t.Errorf("the duplicate stream must be downloaded once: %v", downloads)
+	}
+}
+
+func TestSettleWait(t *testing.T) {
+	var waits []time.Duration
+	setValue(t, &after, func(wait time.Duration) <-chan time.Time {
+		waits = append(waits, wait)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	})
+	logStreams := []*cloudwatchlogs.LogStream{{LogStreamName: aws.String("web-1"), LastIngestionTime: aws.Int64(toMillis(time.Now()))}}
+
+	settleStreams(context.Background(), logStreams)
+	if len(waits) > 0 {
+		t.Errorf("there must be no wait by default, waited %v", waits)
+	}
+
+	setValue(t, &settleWait, time.Minute)
+	settleStreams(context.Background(), logStreams)
+	if len(waits) != 1 || waits[0] > time.Minute || waits[0] < 59*time.Second {
+		t.Errorf("recent events must settle for the rest of the settle wait, waited %v", waits)
+	}
+
+	waits = nil
+	logStreams[0].LastIngestionTime = aws.Int64(toMillis(time.Now().Add(-time.Hour)))
+	settleStreams(context.Background(), logStreams)
+	if len(waits) > 0 {
+		t.Errorf("settled streams must not be waited for, waited %v", waits)
+	}
+}
+
+func TestReproducibleArchive(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+
+	_, first := uploadedArchive(t, fake, Config{"reproducible": "true", "tar-prefix": "logs"})
+	time.Sleep(1100 * time.Millisecond)
+	_, second := uploadedArchive(t, fake, Config{"reproducible": "true", "tar-prefix": "logs"})
+	if !bytes.Equal(first, second) {
+		t.Error("identical logs must produce identical archives")
+	}
+
+	for name, entry := range readTarGz(t, first) {
+		if !entry.header.ModTime.Equal(startDate) {
+			t.Errorf("unexpected modification time for %s: %s", name, entry.header.ModTime)
+		}
+	}
+}
+
+func TestGzipModTime(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	for run := 0; run < 2; run++ {
+		_, archive := uploadedArchive(t, fake, Config{"reproducible": "true"})
+		gr, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gr.ModTime.Equal(time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("the gzip header must record the archived day, got %s", gr.ModTime)
+		}
+	}
+
+	_, archive := uploadedArchive(t, fake, nil)
+	if gr, err := gzip.NewReader(bytes.NewReader(archive)); err != nil || !gr.ModTime.IsZero() {
+		t.Errorf("no modification time must be recorded by default (error: %v)", err)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second", "third")})
+	fake.objects["archives/prod/watermark.json"] = []byte(fmt.Sprintf(`{"web-1": %d}`, at("00:00:01.000")))
+
+	summary, entries := archiveEntries(t, fake, Config{"watermark": "true"})
+	if content := entries["web-1.log"].content; content != "second\nthird\n" {
+		t.Errorf("only the events after the watermark must be archived: %q", content)
+	}
+	if start := int64(fake.calls("GetLogEvents")[0].Input["startTime"].(float64)); start != at("00:00:01.001") {
+		t.Errorf("the window must start after the watermark, got %d", start)
+	}
+	if !strings.HasPrefix(summary.Key, "/prod/2024-06-01-") {
+		t.Errorf("the archive name must contain the time of the run: %s", summary.Key)
+	}
+
+	var watermark map[string]int64
+	content, _ := fake.object("archives", "prod/watermark.json")
+	if err := json.Unmarshal(content, &watermark); err != nil || watermark["web-1"] != at("00:00:03.000") {
+		t.Errorf("the watermark must be updated: %s", content)
+	}
+}
+
+func TestChunkedArchives(t *testing.T) {
+	fake := useFakeAWS(t)
+	for i := 1; i <= 4; i++ {
+		fake.addStreams("prod", &fakeStream{Name: fmt.Sprintf("web-%d", i), Events: events(fmt.Sprintf("stream %d", i))})
+	}
+
+	summary, index := uploadedArchive(t, fake, Config{"chunked": "true", "chunks": "2", "chunk-workers": "1"})
+	if summary.Key != "/prod/2024-06-01.index.json" {
+		t.Errorf("unexpected index key: %s", summary.Key)
+	}
+
+	var chunks chunkIndex
+	if err := json.Unmarshal(index, &chunks); err != nil || len(chunks.Chunks) != 2 {
+		t.Fatalf("the index must list 2 chunks: %s", index)
+	}
+	archived := 0
+	for i, chunk := range chunks.Chunks {
+		if chunk.Key != fmt.Sprintf("/prod/2024-06-01.part%03d.tar.gz", i+1) {
+			t.Errorf("unexpected chunk key: %s", chunk.Key)
+		}
+		archive, ok := fake.object("archives", chunk.Key)
+		if !ok {
+			t.Fatalf("the \"%s\" chunk has not been uploaded", chunk.Key)
+		}
+		entries := readTarGz(t, archive)
+		if len(entries) != len(chunk.Files) {
+			t.Errorf("the index must list the files of the chunk: %v", chunk.Files)
+		}
+		archived += len(entries)
+	}
+	if archived != 4 {
+		t.Errorf("every stream must be archived once, got %d entries", archived)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.handle("DescribeLogStreams", func(req fakeRequest) *fakeResponse {
+		return logsError(http.StatusBadRequest, "AccessDeniedException")
+	})
+	fake.handle("PutObject", func(req fakeRequest) *fakeResponse {
+		return s3Error(http.StatusForbidden, "AccessDenied")
+	})
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"selfcheck": "true"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 actions are not allowed") {
+		t.Errorf("the missing permissions must fail the self-check, got %v", err)
+	}
+
+	allowed := make(map[string]bool)
+	for _, permission := range summary.Permissions {
+		allowed[permission.Action] = permission.Allowed
+	}
+	if allowed["logs:DescribeLogStreams"] || !allowed["s3:HeadBucket"] || allowed["s3:PutObject"] {
+		t.Errorf("unexpected permissions: %+v", summary.Permissions)
+	}
+	if len(fake.calls("GetLogEvents")) > 0 {
+		t.Error("the self-check must not download any log")
+	}
+}
+
+func TestSelfCheckRemovesProbe(t *testing.T) {
+	fake := useFakeAWS(t)
+
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"selfcheck": "true"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fake.calls("PutObject")) != 1 || len(fake.calls("DeleteObject")) != 1 {
+		t.Errorf("the probe must be written then removed, %d writes and %d removals", len(fake.calls("PutObject")), len(fake.calls("DeleteObject")))
+	}
+	if _, ok := fake.object("archives", "/prod/.selfcheck"); ok {
+		t.Error("the probe must not be left in the bucket")
+	}
+
+	fake.handle("DeleteObject", func(req fakeRequest) *fakeResponse {
+		return s3Error(http.StatusForbidden, "AccessDenied")
+	})
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"selfcheck": "true"})); err != nil {
+		t.Errorf("a probe which cannot be removed must not fail the self-check, got %v", err)
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	summary, archive := uploadedArchive(t, fake, Config{"no-compression": "true"})
+	if summary.Key != "/prod/2024-06-01.tar" {
+		t.Errorf("unexpected archive key: %s", summary.Key)
+	}
+	if content := readTar(t, bytes.NewReader(archive))["web-1.log"].content; content != "first\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestUploaderOptions(t *testing.T) {
+	fake := useFakeAWS(t)
+	random := rand.New(rand.NewSource(1))
+	// Random letters are compressed to about 60% of their size, which still needs 3 parts.
+	var messages []string
+	for i := 0; i < 20; i++ {
+		message := make([]byte, 1024*1024)
+		for j := range message {
+			message[j] = byte('a' + random.Intn(26))
+		}
+		messages = append(messages, string(message))
+	}
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events(messages...)})
+
+	var mutex sync.Mutex
+	var concurrent sync.Once
+	inFlight, maxInFlight := 0, 0
+	overlapped := make(chan struct{})
+	fake.handle("UploadPart", func(req fakeRequest) *fakeResponse {
+		mutex.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		if inFlight == 2 {
+			concurrent.Do(func() { close(overlapped) })
+		}
+		mutex.Unlock()
+
+		// Parts are held until two of them are uploaded at the same time, however slow the compression is.
+		select {
+		case <-overlapped:
+		case <-time.After(5 * time.Second):
+		}
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		return nil
+	})
+
+	archiveEntries(t, fake, Config{"stream-upload": "true", "upload-part-size": strconv.Itoa(5 * 1024 * 1024), "upload-concurrency": "2"})
+
+	parts := fake.calls("UploadPart")
+	if len(parts) != 3 || len(parts[0].Body) != 5*1024*1024 {
+		t.Errorf("the archive must be uploaded in parts of 5 MiB, %d parts", len(parts))
+	}
+	if maxInFlight != 2 {
+		t.Errorf("parts must be uploaded 2 at a time, %d at most", maxInFlight)
+	}
+}
+
+func TestDescribeLimit(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	archiveEntries(t, fake, Config{"describe-limit": "5"})
+	if limit := fake.calls("DescribeLogStreams")[0].Input["limit"]; limit != float64(5) {
+		t.Errorf("the limit must be forwarded, got %v", limit)
+	}
+
+	configure(t, Config{"describe-limit": "500"})
+	if describeLimit != maxDescribeLimit {
+		t.Errorf("the limit must be capped at %d, got %d", maxDescribeLimit, describeLimit)
+	}
+
+	if message := expectPanic(t, func() { loadConfig(testConfig(Config{"describe-limit": "0"})) }); !strings.Contains(message, "describe limit") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestMissingBucket(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	fake.handle("HeadBucket", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusNotFound, Header: map[string]string{"X-Amz-Bucket-Region": fakeRegion}}
+	})
+
+	_, err := ArchiveGroup(context.Background(), testConfig(nil))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err == nil || !strings.Contains(err.Error(), "the \"archives\" bucket does not exist") {
+		t.Errorf("a missing bucket must abort the run, got %v", err)
+	}
+	if len(fake.calls("DescribeLogStreams")) > 0 || len(fake.calls("GetLogEvents")) > 0 {
+		t.Error("nothing must be downloaded when the bucket is missing")
+	}
+}
+
+func TestReadme(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "app/1", Events: events("first")})
+
+	_, entries := archiveEntries(t, fake, Config{"include-readme": "true"})
+	readme := entries[readmeName].content
+	for _, expected := range []string{"\"prod\" environment", "\"prod\" log group", "2024-06-01T00:00:00Z", "app_1.log: app/1", "tar -xzf 2024-06-01.tar.gz"} {
+		if !strings.Contains(readme, expected) {
+			t.Errorf("the README must contain %q: %q", expected, readme)
+		}
+	}
+}
+
+func TestHourWindow(t *testing.T) {
+	fake := useFakeAWS(t)
+	before, inside, after := "before", "inside", "after"
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: []fakeEvent{
+		{Timestamp: at("13:59:59.999"), IngestionTime: at("13:59:59.999"), Message: &before},
+		{Timestamp: at("14:00:00.000"), IngestionTime: at("14:00:00.000"), Message: &inside},
+		{Timestamp: at("16:00:00.000"), IngestionTime: at("16:00:00.000"), Message: &after},
+	}})
+
+	summary, entries := archiveEntries(t, fake, Config{"start-hour": "14", "end-hour": "16"})
+	if content := entries["web-1.log"].content; content != "inside\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	input := fake.calls("GetLogEvents")[0].Input
+	if int64(input["startTime"].(float64)) != at("14:00:00.000") || int64(input["endTime"].(float64)) != at("16:00:00.000") {
+		t.Errorf("unexpected window: %v to %v", input["startTime"], input["endTime"])
+	}
+	if summary.Key != "/prod/2024-06-01-14h-16h.tar.gz" {
+		t.Errorf("unexpected archive key: %s", summary.Key)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	var mutex sync.Mutex
+	var payloads []RunSummary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var summary RunSummary
+		json.NewDecoder(r.Body).Decode(&summary)
+		payloads = append(payloads, summary)
+		// The first delivery fails with a server error, which must be retried.
+		if len(payloads) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	var waits []time.Duration
+	setValue(t, &after, func(wait time.Duration) <-chan time.Time {
+		waits = append(waits, wait)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	})
+
+	archiveEntries(t, fake, Config{"webhook-url": server.URL, "webhook-retry-delay": "2s"})
+	if len(payloads) != 2 {
+		t.Fatalf("the failed delivery must be retried once, %d deliveries", len(payloads))
+	}
+	if summary := payloads[1]; !summary.Uploaded || summary.Key != "/prod/2024-06-01.tar.gz" || summary.Events != 1 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if len(waits) != 1 || waits[0] != 2*time.Second {
+		t.Errorf("the retry must wait for the webhook retry delay, got %v", waits)
+	}
+}
+
+func TestWebhookStopsRetriesOnCancel(t *testing.T) {
+	var deliveries int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveries++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	configure(t, Config{"webhook-url": server.URL, "webhook-retry-delay": "1h"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	notifyWebhook(ctx, RunSummary{}, nil)
+	if deliveries != 1 {
+		t.Errorf("the summary must be delivered once without waiting for retries, %d deliveries", deliveries)
+	}
+}
+
+func TestTarOwnership(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	_, entries := archiveEntries(t, fake, Config{"tar-uid": "1000", "tar-gid": "1001", "tar-uname": "logs", "tar-gname": "ops", "tar-prefix": "logs"})
+	for name, entry := range entries {
+		if header := entry.header; header.Uid != 1000 || header.Gid != 1001 || header.Uname != "logs" || header.Gname != "ops" {
+			t.Errorf("unexpected ownership for %s: %d:%d %s:%s", name, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+	}
+	if len(entries) != 2 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func TestGroupTree(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("/svc/a/api", &fakeStream{Name: "web-1", Events: events("api")})
+	fake.addStreams("/svc/a/worker", &fakeStream{Name: "web-1", Events: events("worker")})
+	configure(t, Config{"environment": "", "log-group-prefix": "/svc/a/", "group-tree": "true"})
+	setValue(t, &os.Args, handlerArgs("-environment", "", "-log-group-prefix", "/svc/a/", "-group-tree"))
+
+	// Warm invocations parse the same arguments again, the flags being reset in between.
+	for run := 0; run < 2; run++ {
+		summary, err := LambdaHandler(context.Background(), ScheduledEvent{})
+		if err != nil {
+			t.Fatalf("run %d failed: %v", run, err)
+		}
+		if summary.Key != "/svc_a_/2024-06-01.tar.gz" || len(summary.Groups) != 2 {
+			t.Fatalf("unexpected summary: %+v", summary)
+		}
+	}
+
+	archive, _ := fake.object("archives", "svc_a_/2024-06-01.tar.gz")
+	entries := readTarGz(t, archive)
+	if entries["svc/a/api/web-1.log"].content != "api\n" || entries["svc/a/worker/web-1.log"].content != "worker\n" {
+		t.Errorf("the entries must mirror the names of the log groups: %v", entries)
+	}
+}
+
+func TestMissingTokensAndFields(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.handle("DescribeLogStreams", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{"logStreams": []interface{}{
+			map[string]interface{}{"logStreamName": "web-1", "firstEventTimestamp": at("00:00:01.000"), "lastEventTimestamp": at("00:00:01.000")},
+			map[string]interface{}{},
+		}}}
+	})
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		return &fakeResponse{Status: http.StatusOK, Body: map[string]interface{}{"events": []interface{}{
+			map[string]interface{}{"timestamp": at("00:00:01.000"), "message": "first"},
+			map[string]interface{}{},
+		}}}
+	})
+
+	summary, entries := archiveEntries(t, fake, nil)
+	if summary.Streams != 1 || entries["web-1.log"].content != "first\n" {
+		t.Errorf("unexpected archive: %+v, %v", summary, entries)
+	}
+	if calls := len(fake.calls("GetLogEvents")); calls != 1 {
+		t.Errorf("a page without token must be the last one, %d calls", calls)
+	}
+}
+
+func TestNilMessages(t *testing.T) {
+	fake := useFakeAWS(t)
+	message := "first"
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: []fakeEvent{
+		{Timestamp: at("00:00:01.000"), IngestionTime: at("00:00:01.000"), Message: &message},
+		{Timestamp: at("00:00:02.000"), IngestionTime: at("00:00:02.000")},
+	}})
+
+	summary, entries := archiveEntries(t, fake, nil)
+	if content := entries["web-1.log"].content; content != "first\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	if summary.NilMessages != 1 {
+		t.Errorf("the metadata-only event must be counted, got %d", summary.NilMessages)
+	}
+}
+
+func TestPartialIsSuccess(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+	failed := map[string]bool{"web-2": true}
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if failed[req.Input["logStreamName"].(string)] {
+			return logsError(http.StatusBadRequest, "AccessDeniedException")
+		}
+		return nil
+	})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"partial-is-success": "true"})); err != nil {
+		t.Errorf("a partial run must succeed, got %v", err)
+	}
+	if _, err := ArchiveGroup(context.Background(), testConfig(nil)); err == nil {
+		t.Error("a partial run must fail by default")
+	}
+
+	failed["web-1"] = true
+	if _, err := ArchiveGroup(context.Background(), testConfig(Config{"partial-is-success": "true"})); err == nil {
+		t.Error("a run whose streams all failed must still fail")
+	}
+
+	setValue(t, &partialIsSuccess, true)
+	if outcome := partialOutcome(RunSummary{Streams: 2, FailedStreams: []string{"web-1", "web-2"}, Buckets: []BucketResult{{Bucket: "archives"}}}, errors.New("failed")); outcome == nil {
+		t.Error("uploads of a run whose streams all failed are not successes")
+	}
+}
+
+func TestSnappy(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+
+	summary, archive := uploadedArchive(t, fake, Config{"format": "snappy"})
+	if !strings.HasSuffix(summary.Key, ".tar.sz") {
+		t.Errorf("unexpected archive key: %s", summary.Key)
+	}
+	if content := readTar(t, s2.NewReader(bytes.NewReader(archive)))["web-1.log"].content; content != "first\nsecond\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+}
+
+func TestTelemetryRequiresTag(t *testing.T) {
+	if supportsTelemetry {
+		t.Skip("the binary is built with the otel tag")
+	}
+	configure(t, nil)
+
+	message := expectPanic(t, func() { loadConfig(testConfig(Config{"otel-endpoint": "http://localhost:4318"})) })
+	if !strings.Contains(message, "otel tag") {
+		t.Errorf("the otel-endpoint flag requires the otel tag, got %s", message)
+	}
+}
+
+func TestScheduledEventTime(t *testing.T) {
+	useFakeAWS(t)
+	configure(t, Config{"target": ""})
+	setValue(t, &os.Args, handlerArgs("-target", "", "-list-streams"))
+
+	var event ScheduledEvent
+	if err := json.Unmarshal([]byte(`{"time": "2024-06-02T00:05:00Z"}`), &event); err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() {
+		if _, err := LambdaHandler(context.Background(), event); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if startDate.Format("2006-01-02") != "2024-06-01" {
+		t.Errorf("the day before the scheduled time must be archived, got %s", startDate)
+	}
+
+	// A missing time falls back to the current time, the day before being archived.
+	captureStdout(t, func() { LambdaHandler(context.Background(), ScheduledEvent{}) })
+	if yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02"); startDate.Format("2006-01-02") != yesterday {
+		t.Errorf("the day before the current time must be archived, got %s", startDate)
+	}
+}
+
+func TestNameSuffix(t *testing.T) {
+	configure(t, Config{"name-suffix": "rerun-2"})
+	if key := archiveKey(archiveName()); key != "/prod/2024-06-01.rerun-2.tar.gz" {
+		t.Errorf("unexpected archive key: %s", key)
+	}
+
+	if message := expectPanic(t, func() { loadConfig(testConfig(Config{"name-suffix": "a/b"})) }); !strings.Contains(message, "valid name suffix") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	archiveEntries(t, fake, Config{"storage-class": "INTELLIGENT_TIERING"})
+	if class := fake.calls("PutObject")[0].Header.Get("X-Amz-Storage-Class"); class != "INTELLIGENT_TIERING" {
+		t.Errorf("unexpected storage class: %q", class)
+	}
+
+	if message := expectPanic(t, func() { loadConfig(testConfig(Config{"storage-class": "COLD"})) }); !strings.Contains(message, "valid storage class") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
+
+func TestMemoryLimitSpillsArchive(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	_, entries := archiveEntries(t, fake, Config{"stream-upload": "true", "max-memory-bytes": strconv.Itoa(8 * 1024 * 1024)})
+	if entries["web-1.log"].content != "first\n" {
+		t.Errorf("unexpected archive content: %v", entries)
+	}
+	if len(fake.calls("PutObject")) != 1 || len(fake.calls("CreateMultipartUpload")) > 0 {
+		t.Error("the archive must be staged in the workspace instead of being streamed")
+	}
+}
+
+func TestRetriableCodes(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	calls := 0
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if calls++; calls == 1 {
+			return logsError(http.StatusBadRequest, "DataAlreadyAcceptedException")
+		}
+		return nil
+	})
+
+	_, entries := archiveEntries(t, fake, Config{"retriable-codes": "DataAlreadyAcceptedException", "retry-base-delay": "1ms"})
+	// The retried call is followed by the one detecting the end of the stream.
+	if entries["web-1.log"].content != "first\n" || calls != 3 {
+		t.Errorf("the listed code must be retried, %d calls", calls)
+	}
+
+	calls = 0
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"retry-base-delay": "1ms"}))
+	if err == nil || calls != 1 {
+		t.Errorf("an unlisted code must not be retried, %d calls (error: %v)", calls, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	setValue(t, &retryBaseDelay, 100*time.Millisecond)
+	setValue(t, &retryMaxDelay, time.Second)
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, delay := range expected {
+		if actual := retryDelay(i + 1); actual != delay {
+			t.Errorf("unexpected delay before the retry %d: %v instead of %v", i+1, actual, delay)
+		}
+	}
+}
+
+func TestRetentionCovers(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first"), Retention: 400})
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"min-retention-days": "365"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil || !strings.Contains(summary.Skipped, "retention of 400 days covers the 365 required days") {
+		t.Errorf("the log group must be skipped: %+v (error: %v)", summary, err)
+	}
+	if len(fake.calls("GetLogEvents")) > 0 || len(fake.calls("PutObject")) > 0 {
+		t.Error("a skipped log group must not be archived")
+	}
+
+	if _, entries := archiveEntries(t, fake, Config{"min-retention-days": "500"}); entries["web-1.log"].content != "first\n" {
+		t.Errorf("a shorter retention must be archived: %v", entries)
+	}
+}
+
+func TestCompressionConcurrency(t *testing.T) {
+	setValue(t, &compressionSlots, make(chan struct{}, 2))
+
+	var mutex sync.Mutex
+	active, maxActive := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			compressor := boundedCompressor{gw: gzip.NewWriter(writerFunc(func(p []byte) (int, error) {
+				mutex.Lock()
+				active++
+				maxActive = max(maxActive, active)
+				mutex.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mutex.Lock()
+				active--
+				mutex.Unlock()
+				return len(p), nil
+			}))}
+			compressor.Write([]byte("message"))
+			compressor.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxActive > 2 {
+		t.Errorf("at most 2 compressions must run concurrently, %d did", maxActive)
+	}
+}
+
+// writerFunc adapts a function into an io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+// Write calls the function.
+func (fn writerFunc) Write(p []byte) (int, error) {
+	return fn(p)
+}
+
+func TestRequireStreams(t *testing.T) {
+	fake := useFakeAWS(t)
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	if summary, err := ArchiveGroup(context.Background(), testConfig(nil)); err != nil || summary.Uploaded {
+		t.Errorf("a log group without streams must not fail by default: %+v (error: %v)", summary, err)
+	}
+
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"require-streams": "true"}))
+	if err == nil || !strings.Contains(err.Error(), "no log stream has been found") {
+		t.Errorf("a log group without streams must fail with the require-streams flag, got %v", err)
+	}
+	if len(fake.calls("PutObject")) > 0 {
+		t.Error("nothing must be uploaded")
+	}
+}
+
+func TestDirectoryBucket(t *testing.T) {
+	configure(t, nil)
+
+	err := checkDirectoryBucket("logs--euw1-az1--x-s3")
+	if supportsDirectoryBuckets && err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !supportsDirectoryBuckets && (err == nil || !strings.Contains(err.Error(), "sdkv2 tag")) {
+		t.Errorf("directory buckets require the sdkv2 tag, got %v", err)
+	}
+
+	if err := checkDirectoryBucket("logs--x-s3"); err == nil {
+		t.Error("a directory bucket name without zone must be refused")
+	}
+	if err := checkDirectoryBucket("archives"); err != nil {
+		t.Errorf("general purpose buckets must be accepted, got %v", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	t.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "512")
+	t.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "42")
+	t.Setenv("AWS_REGION", "eu-west-3")
+
+	summary, _ := archiveEntries(t, fake, Config{"diagnostics": "true"})
+	diagnostics := summary.Diagnostics
+	if diagnostics == nil || diagnostics.MemorySize != 512 || diagnostics.FunctionVersion != "42" || diagnostics.Region != "eu-west-3" {
+		t.Fatalf("unexpected diagnostics: %+v", diagnostics)
+	}
+	if diagnostics.GoVersion != runtime.Version() || diagnostics.CPUs == 0 || diagnostics.Goroutines == 0 || diagnostics.Sys == 0 {
+		t.Errorf("the runtime statistics must be collected: %+v", diagnostics)
+	}
+
+	if summary, _ = archiveEntries(t, fake, nil); summary.Diagnostics != nil {
+		t.Error("diagnostics must not be collected by default")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	configure(t, nil)
+	setValue(t, &awsHTTPClient, nil)
+	if client := httpClient(); client != nil {
+		t.Errorf("the default client of the SDK must be kept without timeouts, got %v", client)
+	}
+
+	configure(t, Config{"tls-handshake-timeout": "3s", "http-timeout": "1m"})
+	t.Cleanup(resetServices)
+	resetServices()
+	loadServices()
+
+	if awsSession.Config.HTTPClient != awsHTTPClient || awsHTTPClient == nil {
+		t.Fatal("the session must use the custom client")
+	}
+	if awsHTTPClient.Timeout != time.Minute || awsHTTPClient.Transport.(*http.Transport).TLSHandshakeTimeout != 3*time.Second {
+		t.Errorf("the client must use the configured timeouts: %+v", awsHTTPClient)
+	}
+}
+
+func TestMinArchiveBytes(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	_, err := ArchiveGroup(context.Background(), testConfig(Config{"min-archive-bytes": "4096"}))
+	if err == nil || !strings.Contains(err.Error(), "suspiciously small") {
+		t.Errorf("a too small archive must fail the run, got %v", err)
+	}
+	if len(fake.calls("PutObject")) > 0 {
+		t.Error("a too small archive must not be uploaded by default")
+	}
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"min-archive-bytes": "4096", "min-archive-check": "after", "watermark": "true"}))
+	if err == nil || !strings.Contains(err.Error(), "suspiciously small") {
+		t.Errorf("a too small archive must fail the run, got %v", err)
+	}
+	if _, ok := fake.object("archives", summary.Key); !ok || !summary.Uploaded {
+		t.Errorf("a too small archive must be uploaded and reported as such when checked afterwards: %+v", summary)
+	}
+	if _, ok := fake.object("archives", "prod/watermark.json"); !ok {
+		t.Error("the watermark must be saved along with the uploaded archive")
+	}
+}
+
+func TestStreamResults(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first", "second")},
+		&fakeStream{Name: "web-2", Events: events("third")},
+	)
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		if req.Input["logStreamName"] == "web-2" {
+			return logsError(http.StatusBadRequest, "InvalidParameterException")
+		}
+		return nil
+	})
+
+	summary, _ := ArchiveGroup(context.Background(), testConfig(nil))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	results := summary.StreamResults
+	if len(results) != 2 {
+		t.Fatalf("one result per stream is expected: %+v", results)
+	}
+	if results[0] != (StreamResult{Name: "web-1", Events: 2, Bytes: int64(len("first\nsecond\n"))}) {
+		t.Errorf("unexpected result: %+v", results[0])
+	}
+	if results[1].Name != "web-2" || results[1].Events != 0 || !strings.Contains(results[1].Error, "InvalidParameterException") {
+		t.Errorf("unexpected result: %+v", results[1])
+	}
+}
+
+func TestListStreams(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first"), StoredBytes: 1000},
+		&fakeStream{Name: "web-2", StoredBytes: 20},
+		&fakeStream{Name: "access-1", Events: events("GET /"), StoredBytes: 10},
+	)
+	configure(t, Config{"list-streams": "true"})
+
+	output := captureStdout(t, func() {
+		if err := listStreams(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected output: %q", output)
+	}
+	for i, expected := range [][]string{
+		{"STREAM", "LAST", "EVENT", "STORED", "BYTES", "ACTIVE"},
+		{"web-1", "2024-06-01T00:00:01Z", "1000", "true"},
+		{"web-2", "-", "20", "false"},
+	} {
+		if fields := strings.Fields(lines[i]); strings.Join(fields, " ") != strings.Join(expected, " ") {
+			t.Errorf("unexpected row: %q", lines[i])
+		}
+	}
+}
+
+func TestGzipHeader(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+
+	_, archive := uploadedArchive(t, fake, Config{"gzip-comment": "Archivé par le job de rétention"})
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.Name != "2024-06-01.tar" || gr.Comment != "Archivé par le job de rétention" {
+		t.Errorf("unexpected gzip header: %q, %q", gr.Name, gr.Comment)
+	}
+
+	if message := expectPanic(t, func() { loadConfig(testConfig(Config{"gzip-comment": "日志"})) }); !strings.Contains(message, "valid gzip comment") {
+		t.Errorf("unexpected error: %s", message)
+	}
+}
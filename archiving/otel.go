@@ -0,0 +1,119 @@
+//go:build otel
+// +build otel
+
+package archiving
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// supportsTelemetry tells whether spans and metrics can be exported, the OpenTelemetry SDK being only part of the
+// binaries built with the otel tag.
+const supportsTelemetry = true
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	tracer         trace.Tracer
+	eventsCounter  metric.Int64Counter
+	bytesCounter   metric.Int64Counter
+)
+
+// initTelemetry creates the OpenTelemetry providers exporting spans and metrics via OTLP when an endpoint is defined,
+// telemetry being a no-op otherwise.
+func initTelemetry() {
+	shutdownTelemetry()
+	if len(otelEndpoint) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	traceExporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(otelEndpoint))
+	check(err)
+	metricExporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(otelEndpoint))
+	check(err)
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter))
+	meterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)))
+	tracer = tracerProvider.Tracer("lambda-logs-archiving")
+
+	meter := meterProvider.Meter("lambda-logs-archiving")
+	eventsCounter, err = meter.Int64Counter("logs_archiving.events", metric.WithDescription("The number of archived log events."))
+	check(err)
+	bytesCounter, err = meter.Int64Counter("logs_archiving.bytes", metric.WithUnit("By"), metric.WithDescription("The size of the archived log events."))
+	check(err)
+}
+
+// shutdownTelemetry stops the providers created for a previous run, whose endpoint may no longer be the configured one.
+func shutdownTelemetry() {
+	if tracerProvider == nil {
+		return
+	}
+
+	duration, _ := time.ParseDuration(timeout)
+	ctx, cancelFn := context.WithTimeout(context.Background(), duration)
+	defer cancelFn()
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Println(fmt.Sprintf("Unable to stop the OpenTelemetry tracer provider, %v", err))
+	}
+	if err := meterProvider.Shutdown(ctx); err != nil {
+		log.Println(fmt.Sprintf("Unable to stop the OpenTelemetry meter provider, %v", err))
+	}
+	tracerProvider, meterProvider, tracer = nil, nil, nil
+}
+
+// flushTelemetry exports the pending spans and metrics, as the execution environment may be frozen between invocations.
+func flushTelemetry(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		log.Println(fmt.Sprintf("Unable to export the OpenTelemetry spans, %v", err))
+	}
+	if err := meterProvider.ForceFlush(ctx); err != nil {
+		log.Println(fmt.Sprintf("Unable to export the OpenTelemetry metrics, %v", err))
+	}
+}
+
+// recordMetrics adds the downloaded events and bytes to the OpenTelemetry counters.
+func recordMetrics(ctx context.Context, summary *RunSummary) {
+	if meterProvider == nil {
+		return
+	}
+
+	group := metric.WithAttributes(attribute.String("log_group", logGroup))
+	eventsCounter.Add(ctx, summary.Events, group)
+	bytesCounter.Add(ctx, summary.Bytes, group)
+}
+
+// traceSpan runs a stage of the process in an OpenTelemetry span when an endpoint is defined.
+func traceSpan(ctx context.Context, name string, fn func(context.Context) error) error {
+	if tracer == nil {
+		return fn(ctx)
+	}
+
+	ctx, span := tracer.Start(ctx, name)
+	defer span.End()
+
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build !otel
+// +build !otel
+
+package archiving
+
+import "context"
+
+// supportsTelemetry tells whether spans and metrics can be exported, the OpenTelemetry SDK being only part of the
+// binaries built with the otel tag.
+const supportsTelemetry = false
+
+// initTelemetry does nothing, as an OpenTelemetry endpoint is refused at startup without the otel tag.
+func initTelemetry() {}
+
+// flushTelemetry does nothing, as nothing is exported without the otel tag.
+func flushTelemetry(context.Context) {}
+
+// recordMetrics does nothing, as nothing is exported without the otel tag.
+func recordMetrics(context.Context, *RunSummary) {}
+
+// traceSpan runs a stage of the process as is, as spans are never recorded without the otel tag.
+func traceSpan(ctx context.Context, _ string, fn func(context.Context) error) error {
+	return fn(ctx)
+}
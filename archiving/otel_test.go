@@ -0,0 +1,32 @@
+//go:build otel
+// +build otel
+
+package archiving
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTelemetrySpans(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+
+	recorder := tracetest.NewSpanRecorder()
+	setValue(t, &tracer, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+
+	archiveEntries(t, fake, nil)
+
+	spans := make(map[string]int)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()]++
+	}
+	if spans["download"] != 2 || spans["archive"] != 1 || spans["upload"] != 1 {
+		t.Errorf("unexpected spans: %v", spans)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !sdkv2
+// +build !sdkv2
+
+package archiving
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// supportsDirectoryBuckets tells whether uploads handle the session authentication of S3 directory buckets, which the
+// first version of the SDK does not.
+const supportsDirectoryBuckets = false
+
+// sdkV1Logs implements the CloudWatch Logs operations with the first version of the AWS SDK.
+type sdkV1Logs struct {
+	client *cloudwatchlogs.CloudWatchLogs
+}
+
+// newLogsAPI returns the CloudWatch Logs operations backed by the shared client.
+func newLogsAPI() logsAPI {
+	return sdkV1Logs{client: cwService}
+}
+
+// DescribeLogStreams retrieves a page of log streams.
+func (l sdkV1Logs) DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	return l.client.DescribeLogStreamsWithContext(ctx, input)
+}
+
+// GetLogEvents retrieves a page of log events.
+func (l sdkV1Logs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	return l.client.GetLogEventsWithContext(ctx, input)
+}
+
+// sdkV1Objects implements the S3 operations with the first version of the AWS SDK.
+type sdkV1Objects struct {
+	client *s3.S3
+}
+
+// newObjectsAPI returns the S3 operations backed by the client of the destination region.
+func newObjectsAPI(client *s3.S3) objectsAPI {
+	return sdkV1Objects{client: client}
+}
+
+// PutObject uploads an object.
+func (o sdkV1Objects) PutObject(ctx context.Context, input *s3.PutObjectInput) error {
+	_, err := o.client.PutObjectWithContext(ctx, input)
+	return err
+}
+
+// DeleteObject removes an object.
+func (o sdkV1Objects) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput) error {
+	_, err := o.client.DeleteObjectWithContext(ctx, input)
+	return err
+}
@@ -0,0 +1,209 @@
+//go:build sdkv2
+// +build sdkv2
+
+package archiving
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	retryv2 "github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	cloudwatchlogsv2 "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// supportsDirectoryBuckets tells whether uploads handle the session authentication of S3 directory buckets, which the
+// second version of the SDK does transparently.
+const supportsDirectoryBuckets = true
+
+// Only the operations which move the logs (downloads and uploads) are migrated to the second version of the SDK, where
+// the gains are: the other ones are occasional calls whose X-Ray tracing and error handling rely on the first version.
+var (
+	// sdkV2Config is the configuration shared by all clients of the second version of the AWS SDK.
+	sdkV2Config awsv2.Config
+
+	// sdkV2S3 is the S3 client shared by all uploads, the region of each destination being set per request.
+	sdkV2S3 *s3v2.Client
+)
+
+// sdkV2Logs implements the CloudWatch Logs operations with the second version of the AWS SDK.
+type sdkV2Logs struct {
+	client *cloudwatchlogsv2.Client
+}
+
+// newLogsAPI loads the configuration of the second version of the SDK, creates its S3 client along with the other
+// services, and returns the CloudWatch Logs operations.
+func newLogsAPI() logsAPI {
+	options := []func(*config.LoadOptions) error{config.WithRetryer(newSDKV2Retryer)}
+	if len(profile) > 0 {
+		options = append(options, config.WithSharedConfigProfile(profile))
+	}
+	if len(region) > 0 {
+		options = append(options, config.WithRegion(region))
+	}
+	if awsHTTPClient != nil {
+		options = append(options, config.WithHTTPClient(sdkV2HTTPClient(awsHTTPClient)))
+	}
+
+	var err error
+	sdkV2Config, err = config.LoadDefaultConfig(context.Background(), options...)
+	check(err)
+	sdkV2S3 = s3v2.NewFromConfig(sdkV2Config)
+
+	return sdkV2Logs{client: cloudwatchlogsv2.NewFromConfig(sdkV2Config)}
+}
+
+// newSDKV2Retryer returns the retryer of the second version of the SDK, which applies the retry options of the process
+// (attempts, delays and retriable codes) as its errors are not retried again by the process.
+func newSDKV2Retryer() awsv2.Retryer {
+	codes := make(map[string]struct{})
+	for _, code := range retriableCodes {
+		codes[code] = struct{}{}
+	}
+
+	return retryv2.NewStandard(func(o *retryv2.StandardOptions) {
+		o.MaxAttempts = maxRetries + 1
+		o.Backoff = retryv2.BackoffDelayerFunc(func(attempt int, _ error) (time.Duration, error) {
+			return retryDelay(attempt), nil
+		})
+		o.Retryables = append(o.Retryables, retryv2.RetryableErrorCode{Codes: codes})
+		o.RateLimiter = ratelimit.None
+	})
+}
+
+// sdkV2HTTPClient returns the HTTP client of the second version of the SDK, standard transports being rebuilt into a
+// buildable client so that the SDK can still customize them (e.g. with the certificates of AWS_CA_BUNDLE).
+func sdkV2HTTPClient(client *http.Client) config.HTTPClient {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return client
+	}
+
+	return awshttp.NewBuildableClient().WithTimeout(client.Timeout).WithTransportOptions(func(t *http.Transport) {
+		t.DialContext = transport.DialContext
+		t.TLSHandshakeTimeout = transport.TLSHandshakeTimeout
+	})
+}
+
+// DescribeLogStreams retrieves a page of log streams.
+func (l sdkV2Logs) DescribeLogStreams(ctx context.Context, input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	page, err := l.client.DescribeLogStreams(ctx, &cloudwatchlogsv2.DescribeLogStreamsInput{
+		Descending:          input.Descending,
+		Limit:               int32Value(input.Limit),
+		LogGroupName:        input.LogGroupName,
+		LogStreamNamePrefix: input.LogStreamNamePrefix,
+		NextToken:           input.NextToken,
+		OrderBy:             cwtypes.OrderBy(aws.StringValue(input.OrderBy)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &cloudwatchlogs.DescribeLogStreamsOutput{NextToken: page.NextToken}
+	for _, logStream := range page.LogStreams {
+		output.LogStreams = append(output.LogStreams, &cloudwatchlogs.LogStream{
+			Arn:                 logStream.Arn,
+			CreationTime:        logStream.CreationTime,
+			FirstEventTimestamp: logStream.FirstEventTimestamp,
+			LastEventTimestamp:  logStream.LastEventTimestamp,
+			LastIngestionTime:   logStream.LastIngestionTime,
+			LogStreamName:       logStream.LogStreamName,
+			StoredBytes:         logStream.StoredBytes,
+			UploadSequenceToken: logStream.UploadSequenceToken,
+		})
+	}
+
+	return output, nil
+}
+
+// GetLogEvents retrieves a page of log events.
+func (l sdkV2Logs) GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	page, err := l.client.GetLogEvents(ctx, &cloudwatchlogsv2.GetLogEventsInput{
+		EndTime:       input.EndTime,
+		Limit:         int32Value(input.Limit),
+		LogGroupName:  input.LogGroupName,
+		LogStreamName: input.LogStreamName,
+		NextToken:     input.NextToken,
+		StartFromHead: input.StartFromHead,
+		StartTime:     input.StartTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &cloudwatchlogs.GetLogEventsOutput{
+		NextBackwardToken: page.NextBackwardToken,
+		NextForwardToken:  page.NextForwardToken,
+	}
+	for _, event := range page.Events {
+		output.Events = append(output.Events, &cloudwatchlogs.OutputLogEvent{
+			IngestionTime: event.IngestionTime,
+			Message:       event.Message,
+			Timestamp:     event.Timestamp,
+		})
+	}
+
+	return output, nil
+}
+
+// sdkV2Objects implements the S3 operations with the second version of the AWS SDK.
+type sdkV2Objects struct {
+	client *s3v2.Client
+	region string
+}
+
+// newObjectsAPI returns the S3 operations of the shared client for the region of the given client.
+func newObjectsAPI(client *s3.S3) objectsAPI {
+	return sdkV2Objects{client: sdkV2S3, region: aws.StringValue(client.Config.Region)}
+}
+
+// PutObject uploads an object.
+func (o sdkV2Objects) PutObject(ctx context.Context, input *s3.PutObjectInput) error {
+	_, err := o.client.PutObject(ctx, &s3v2.PutObjectInput{
+		ACL:                 s3types.ObjectCannedACL(aws.StringValue(input.ACL)),
+		Body:                input.Body,
+		Bucket:              input.Bucket,
+		ExpectedBucketOwner: input.ExpectedBucketOwner,
+		Key:                 input.Key,
+		Metadata:            awsv2.ToStringMap(input.Metadata),
+		StorageClass:        s3types.StorageClass(aws.StringValue(input.StorageClass)),
+	}, o.withRegion)
+
+	return err
+}
+
+// DeleteObject removes an object.
+func (o sdkV2Objects) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput) error {
+	_, err := o.client.DeleteObject(ctx, &s3v2.DeleteObjectInput{
+		Bucket:              input.Bucket,
+		ExpectedBucketOwner: input.ExpectedBucketOwner,
+		Key:                 input.Key,
+	}, o.withRegion)
+
+	return err
+}
+
+// withRegion sends a request to the region of the destination.
+func (o sdkV2Objects) withRegion(options *s3v2.Options) {
+	options.Region = o.region
+}
+
+// int32Value converts an optional limit of the first version of the SDK.
+func int32Value(value *int64) *int32 {
+	if value == nil {
+		return nil
+	}
+
+	return awsv2.Int32(int32(*value))
+}
@@ -0,0 +1,151 @@
+//go:build sdkv2
+// +build sdkv2
+
+package archiving
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+func TestHandlerWithSDKV2(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first", "second")})
+	configure(t, nil)
+	setValue(t, &os.Args, handlerArgs())
+
+	if _, ok := logsService.(sdkV2Logs); !ok {
+		t.Fatalf("the second version of the SDK must be used, got %T", logsService)
+	}
+
+	summary, err := LambdaHandler(context.Background(), ScheduledEvent{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	archive, ok := fake.object("archives", summary.Key)
+	if !ok {
+		t.Fatalf("the \"%s\" archive has not been uploaded", summary.Key)
+	}
+	if content := readTarGz(t, archive)["web-1.log"].content; content != "first\nsecond\n" {
+		t.Errorf("unexpected archive content: %q", content)
+	}
+	if len(fake.calls("DescribeLogStreams")) == 0 || len(fake.calls("GetLogEvents")) == 0 {
+		t.Error("the log streams must be read through the fake services")
+	}
+}
+
+func TestSDKV2ErrorsAreNotRetriedTwice(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		return logsError(http.StatusBadRequest, "AccessDeniedException")
+	})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	if _, err := ArchiveGroup(context.Background(), testConfig(nil)); err == nil {
+		t.Error("the failed stream must be reported")
+	}
+	if calls := len(fake.calls("GetLogEvents")); calls != 1 {
+		t.Errorf("a client error must not be retried, %d calls", calls)
+	}
+}
+
+func TestSDKV2ObjectsClientIsShared(t *testing.T) {
+	useFakeAWS(t)
+
+	local := newObjectsAPI(s3Service).(sdkV2Objects)
+	remote := newObjectsAPI(s3.New(awsSession, aws.NewConfig().WithRegion("eu-west-3"))).(sdkV2Objects)
+	if local.client != sdkV2S3 || remote.client != sdkV2S3 {
+		t.Error("uploads must share the S3 client created with the other services")
+	}
+	if local.region != fakeRegion || remote.region != "eu-west-3" {
+		t.Errorf("uploads must target the region of their destination, got %s and %s", local.region, remote.region)
+	}
+}
+
+func TestSDKV2RetryOptions(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	fake.handle("GetLogEvents", func(req fakeRequest) *fakeResponse {
+		return logsError(http.StatusServiceUnavailable, "ServiceUnavailableException")
+	})
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+
+	cfg := testConfig(Config{"max-retries": "2", "retry-base-delay": "1ms", "retry-max-delay": "1ms"})
+	if _, err := ArchiveGroup(context.Background(), cfg); err == nil {
+		t.Error("the failed stream must be reported")
+	}
+	if calls := len(fake.calls("GetLogEvents")); calls != 3 {
+		t.Errorf("the SDK must retry as many times as configured, %d calls", calls)
+	}
+}
+
+func TestDirectoryBucketUpload(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod", &fakeStream{Name: "web-1", Events: events("first")})
+	fake.handle("ListObjectsV2", func(req fakeRequest) *fakeResponse {
+		if _, ok := req.Query["session"]; !ok {
+			return nil
+		}
+		return &fakeResponse{Status: http.StatusOK, Body: "<CreateSessionResult><Credentials>" +
+			"<SessionToken>token</SessionToken><SecretAccessKey>secret</SecretAccessKey><AccessKeyId>key</AccessKeyId>" +
+			"<Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></CreateSessionResult>"}
+	})
+
+	summary, err := ArchiveGroup(context.Background(), testConfig(Config{"bucket": "logs--euw1-az1--x-s3", "storage-class": "EXPRESS_ONEZONE"}))
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	put := fake.calls("PutObject")
+	if len(put) != 1 || put[0].Bucket != "logs--euw1-az1--x-s3" || put[0].Key != "prod/2024-06-01.tar.gz" {
+		t.Fatalf("unexpected uploads: %+v", put)
+	}
+	if class := put[0].Header.Get("X-Amz-Storage-Class"); class != "EXPRESS_ONEZONE" {
+		t.Errorf("unexpected storage class: %q", class)
+	}
+	if len(fake.calls("HeadBucket")) > 0 {
+		t.Error("directory buckets must not be checked with the first version of the SDK")
+	}
+	archive, _ := fake.object("logs--euw1-az1--x-s3", summary.Key)
+	if entries := readTarGz(t, archive); entries["web-1.log"].content != "first\n" {
+		t.Errorf("unexpected archive content: %v", entries)
+	}
+}
+
+func TestSDKV2HTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	bundle := t.TempDir() + "/ca.pem"
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certificate, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+
+	configure(t, Config{"tls-handshake-timeout": "3s", "http-timeout": "1m"})
+	t.Cleanup(resetServices)
+	resetServices()
+	loadServices()
+
+	client, ok := sdkV2Config.HTTPClient.(*awshttp.BuildableClient)
+	if !ok || client.GetTimeout() != time.Minute || client.GetTransport().TLSHandshakeTimeout != 3*time.Second {
+		t.Fatalf("the client must use the configured timeouts, got %T", sdkV2Config.HTTPClient)
+	}
+	if client.GetTransport().TLSClientConfig.RootCAs == nil {
+		t.Error("the certificates of the bundle must be trusted")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build xray
+// +build xray
+
+package archiving
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// tracingEnabled checks whether the function runs under AWS X-Ray, which defines the trace header of the invocation.
+func tracingEnabled() bool {
+	return len(os.Getenv("_X_AMZN_TRACE_ID")) > 0
+}
+
+// traceClient records the calls of an AWS client as X-Ray subsegments when tracing is enabled.
+func traceClient(c *client.Client) {
+	if tracingEnabled() {
+		xray.AWS(c)
+	}
+}
+
+// captureSubsegment runs a stage of the process in an X-Ray subsegment.
+func captureSubsegment(ctx context.Context, name string, fn func(context.Context) error) error {
+	return xray.Capture(ctx, name, fn)
+}
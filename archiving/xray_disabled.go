@@ -0,0 +1,23 @@
+//go:build !xray
+// +build !xray
+
+package archiving
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+)
+
+// tracingEnabled always returns false, as the X-Ray SDK is only part of the binaries built with the xray tag.
+func tracingEnabled() bool {
+	return false
+}
+
+// traceClient does nothing, as calls are never traced without the xray tag.
+func traceClient(*client.Client) {}
+
+// captureSubsegment runs a stage of the process as is, as subsegments are never recorded without the xray tag.
+func captureSubsegment(ctx context.Context, _ string, fn func(context.Context) error) error {
+	return fn(ctx)
+}
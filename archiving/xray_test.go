@@ -0,0 +1,59 @@
+//go:build xray
+// +build xray
+
+package archiving
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+func TestXRaySubsegments(t *testing.T) {
+	fake := useFakeAWS(t)
+	fake.addStreams("prod",
+		&fakeStream{Name: "web-1", Events: events("first")},
+		&fakeStream{Name: "web-2", Events: events("second")},
+	)
+
+	emitter := &segmentRecorder{}
+	if err := xray.Configure(xray.Config{Emitter: emitter}); err != nil {
+		t.Fatal(err)
+	}
+	header := "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+	t.Setenv("_X_AMZN_TRACE_ID", header)
+	// The X-Ray SDK reads the trace header of Lambda invocations from a plain string key.
+	var traceHeaderKey interface{} = xray.LambdaTraceHeaderKey
+	ctx := context.WithValue(context.Background(), traceHeaderKey, header)
+
+	t.Cleanup(func() { loadConfig(testConfig(nil)) })
+	if _, err := ArchiveGroup(ctx, testConfig(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if emitter.names["download"] != 2 || emitter.names["archive"] != 1 || emitter.names["upload"] != 1 {
+		t.Errorf("unexpected subsegments: %v", emitter.names)
+	}
+}
+
+// segmentRecorder counts the X-Ray segments emitted by name.
+type segmentRecorder struct {
+	mutex sync.Mutex
+	names map[string]int
+}
+
+// Emit counts the segment.
+func (r *segmentRecorder) Emit(seg *xray.Segment) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names == nil {
+		r.names = make(map[string]int)
+	}
+	r.names[seg.Name]++
+}
+
+// RefreshEmitterWithAddress does nothing, as segments are never sent.
+func (r *segmentRecorder) RefreshEmitterWithAddress(raddr *net.UDPAddr) {}
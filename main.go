@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+
+	"github.com/ajardin/lambda-logs-archiving/archiving"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	// The runtime API is only defined inside a Lambda execution environment, the process is run as a CLI otherwise.
+	if len(os.Getenv("AWS_LAMBDA_RUNTIME_API")) > 0 {
+		lambda.Start(archiving.LambdaHandler)
+		return
+	}
+
+	os.Exit(archiving.RunCLI())
+}